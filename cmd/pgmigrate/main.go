@@ -0,0 +1,103 @@
+/**
+ pgmigrate applies or rolls back schema migrations.
+
+ usage:
+   pgmigrate up [n]      apply pending migrations, all by default
+   pgmigrate down [n]    roll back the latest n migrations, 1 by default
+   pgmigrate status      list migrations and their state
+
+ env variables:
+   pg_url or pg_host, pg_port, ...   database, see storage.PgConfigFromEnv
+   migrate_dir                       migration files directory, default: ./migrations
+   migrate_table                     version table, default: schema_migrations
+   migrate_dry_run                   print sql without executing
+**/
+package main
+
+import "os"
+import "fmt"
+import "errors"
+import "strconv"
+import "context"
+
+import "github.com/jackielihf/golib/storage"
+
+
+var errUsage = errors.New("usage: pgmigrate up [n] | down [n] | status")
+
+// exit after run returns, so that deferred cleanup like closing the client has run
+func main() {
+    if err := run(os.Args[1:]); err != nil {
+        if err == errUsage {
+            fmt.Println(err.Error())
+            os.Exit(2)
+        }
+        fmt.Println("pgmigrate: " + err.Error())
+        os.Exit(1)
+    }
+}
+
+func run(args []string) error {
+    if len(args) < 1 {
+        return errUsage
+    }
+    command := args[0]
+    if command != "up" && command != "down" && command != "status" {
+        return errUsage
+    }
+    steps := 0
+    if len(args) > 1 {
+        var err error
+        if steps, err = strconv.Atoi(args[1]); err != nil {
+            return errUsage
+        }
+    }
+
+    config, err := storage.PgConfigFromEnv()
+    if err != nil {
+        return err
+    }
+    dir := os.Getenv("migrate_dir")
+    if dir == "" {
+        dir = "migrations"
+    }
+    client := storage.NewPgClient(config)
+    client.Open()
+    defer client.Close()
+
+    migrator := storage.NewMigrator(client, os.DirFS(dir))
+    migrator.Table = os.Getenv("migrate_table")
+    migrator.DryRun, _ = strconv.ParseBool(os.Getenv("migrate_dry_run"))
+
+    ctx := context.Background()
+    if command == "status" {
+        list, err := migrator.Status(ctx)
+        if err != nil {
+            return err
+        }
+        for _, s := range list {
+            if s.Applied {
+                fmt.Printf("%d_%s\tapplied at %s\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+            }else{
+                fmt.Printf("%d_%s\tpending\n", s.Version, s.Name)
+            }
+        }
+        return nil
+    }
+    var done []storage.Migration
+    if command == "up" {
+        done, err = migrator.Up(ctx, steps)
+    }else{
+        done, err = migrator.Down(ctx, steps)
+    }
+    for _, m := range done {
+        fmt.Printf("%s %d_%s\n", command, m.Version, m.Name)
+    }
+    if err != nil {
+        return err
+    }
+    if len(done) == 0 {
+        fmt.Println("nothing to migrate")
+    }
+    return nil
+}
@@ -6,18 +6,25 @@ package main
 
 import "github.com/gin-gonic/gin"
 import "github.com/jackielihf/golib/web"
+import "github.com/jackielihf/golib/web/auth"
+import "os"
 import "fmt"
 
 
 
-func login(c *gin.Context) {
-    username := c.Query("username")
-    obj := map[string]string{"username": username}
-    web.JwtSetCookie(c, obj)    
-    c.JSON(200, gin.H{
-        "message": username,
-    })
-    c.Abort()
+// a demo user, the password is env example_password or "secret"
+func newLogin() *auth.Login {
+    password := os.Getenv("example_password")
+    if password == "" {
+        password = "secret"
+    }
+    hash, err := auth.HashPassword(password)
+    if err != nil {
+        panic(err)
+    }
+    users := auth.NewMemoryUserStore()
+    users.Add("admin", &auth.User{Id: "1", PasswordHash: hash})
+    return auth.NewLogin(users)
 }
 
 func handler(c *gin.Context) {
@@ -40,8 +47,10 @@ func handler(c *gin.Context) {
 
 
 func GetApiConfig() []web.Api{
+    login := newLogin()
     config := []web.Api {
-        web.Api{"GET", "/login", web.ApiHandlers{login}},
+        web.Api{"POST", "/login", web.ApiHandlers{login.LoginHandler}},
+        web.Api{"POST", "/logout", web.ApiHandlers{login.LogoutHandler}},
         web.Api{"GET", "/example", web.ApiHandlers{handler}},
     }    
     return config
@@ -0,0 +1,235 @@
+package storage
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "github.com/lib/pq"
+)
+
+// bulk ingestion
+// CopyFrom streams rows by COPY FROM STDIN, InsertMany sends multi-row inserts in chunks.
+// both run in one transaction, and return the number of rows written.
+
+// max number of parameters of a postgresql statement
+const maxParams = 65535
+
+// rows iterator
+type CopySource interface {
+    Next() bool
+    Values() ([]interface{}, error)
+    Err() error
+}
+
+type BulkOptions struct {
+    IgnoreConflicts bool    // ON CONFLICT DO NOTHING
+    ConflictTarget string   // optional, e.g. "(id)" or "ON CONSTRAINT users_pkey"
+}
+
+func (that *BulkOptions) onConflict() string {
+    if that == nil || !that.IgnoreConflicts {
+        return ""
+    }
+    if that.ConflictTarget != "" {
+        return " ON CONFLICT " + that.ConflictTarget + " DO NOTHING"
+    }
+    return " ON CONFLICT DO NOTHING"
+}
+
+type sliceSource struct {
+    rows [][]interface{}
+    index int
+}
+
+// iterate a slice of rows
+func CopyFromRows(rows [][]interface{}) CopySource {
+    return &sliceSource{rows, -1}
+}
+
+func (that *sliceSource) Next() bool {
+    that.index++
+    return that.index < len(that.rows)
+}
+
+func (that *sliceSource) Values() ([]interface{}, error) {
+    return that.rows[that.index], nil
+}
+
+func (that *sliceSource) Err() error {
+    return nil
+}
+
+// a temp table name of its own per call, so calls on one pooled connection, or a caller's table, don't clash
+func copyTempTable() string {
+    buf := make([]byte, 8)
+    rand.Read(buf)
+    return "_golib_copy_" + hex.EncodeToString(buf)
+}
+
+// COPY statement, "schema.table" is supported
+func copyInSql(table string, columns []string) string {
+    if i := strings.Index(table, "."); i > 0 {
+        return pq.CopyInSchema(table[:i], table[i + 1:], columns...)
+    }
+    return pq.CopyIn(table, columns...)
+}
+
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows CopySource) (int64, error) {
+    stmt, err := tx.PrepareContext(ctx, copyInSql(table, columns))
+    if err != nil {
+        return 0, err
+    }
+    defer stmt.Close()
+    var count int64
+    for rows.Next() {
+        values, err2 := rows.Values()
+        if err2 != nil {
+            return count, err2
+        }
+        if len(values) != len(columns) {
+            return count, fmt.Errorf("copy row %d: %d values for %d columns", count + 1, len(values), len(columns))
+        }
+        if _, err2 = stmt.ExecContext(ctx, values...); err2 != nil {
+            return count, err2
+        }
+        count++
+    }
+    if err2 := rows.Err(); err2 != nil {
+        return count, err2
+    }
+    // flush
+    if _, err2 := stmt.ExecContext(ctx); err2 != nil {
+        return count, err2
+    }
+    return count, nil
+}
+
+// copy rows into table
+func (that *PgClient) CopyFrom(table string, columns []string, rows CopySource, opts *BulkOptions) (int64, error) {
+    return that.CopyFromContext(context.Background(), table, columns, rows, opts)
+}
+
+// with IgnoreConflicts, rows are copied into a temp table first, then inserted with ON CONFLICT DO NOTHING
+func (that *PgClient) CopyFromContext(ctx context.Context, table string, columns []string, rows CopySource, opts *BulkOptions) (count int64, err error) {
+    ctx, event := that.beforeQuery(ctx, "copy", copyInSql(table, columns), nil)
+    defer func(){ that.afterQuery(ctx, event, count, err) }()
+    tx, err := that.Db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, mapContextErr(ctx, err)
+    }
+    defer tx.Rollback()
+
+    onConflict := opts.onConflict()
+    if onConflict == "" {
+        copied, err2 := copyRows(ctx, tx, table, columns, rows)
+        if err2 != nil {
+            return 0, mapContextErr(ctx, err2)
+        }
+        return copied, mapContextErr(ctx, tx.Commit())
+    }
+    // through a temp table
+    temp := copyTempTable()
+    createSql := fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", temp, strings.Join(columns, ","), table)
+    if _, err2 := tx.ExecContext(ctx, createSql); err2 != nil {
+        return 0, mapContextErr(ctx, err2)
+    }
+    if _, err2 := copyRows(ctx, tx, temp, columns, rows); err2 != nil {
+        return 0, mapContextErr(ctx, err2)
+    }
+    fields := strings.Join(columns, ",")
+    insertSql := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s", table, fields, fields, temp, onConflict)
+    res, err := tx.ExecContext(ctx, insertSql)
+    if err != nil {
+        return 0, mapContextErr(ctx, err)
+    }
+    inserted, err := res.RowsAffected()
+    if err != nil {
+        return 0, err
+    }
+    return inserted, mapContextErr(ctx, tx.Commit())
+}
+
+// build a multi-row insert sql
+func buildInsertManySql(table string, columns []string, rowNum int, onConflict string) string {
+    n := len(columns)
+    values := make([]string, rowNum)
+    placeholders := make([]string, n)
+    for r := 0; r < rowNum; r++ {
+        for i := 0; i < n; i++ {
+            placeholders[i] = fmt.Sprintf("$%d", r * n + i + 1)
+        }
+        values[r] = "(" + strings.Join(placeholders, ",") + ")"
+    }
+    return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s%s", table, strings.Join(columns, ","), strings.Join(values, ","), onConflict)
+}
+
+// insert rows by multi-row inserts, chunked to stay within the parameter limit
+func (that *PgClient) InsertMany(table string, columns []string, rows CopySource, opts *BulkOptions) (int64, error) {
+    return that.InsertManyContext(context.Background(), table, columns, rows, opts)
+}
+
+func (that *PgClient) InsertManyContext(ctx context.Context, table string, columns []string, rows CopySource, opts *BulkOptions) (total int64, err error) {
+    if len(columns) == 0 {
+        return 0, fmt.Errorf("InsertMany err: no columns")
+    }
+    if len(columns) > maxParams {
+        return 0, fmt.Errorf("InsertMany err: %d columns, at most %d", len(columns), maxParams)
+    }
+    ctx, event := that.beforeQuery(ctx, "insert_many", buildInsertManySql(table, columns, 1, opts.onConflict()), nil)
+    defer func(){ that.afterQuery(ctx, event, total, err) }()
+    chunkSize := maxParams / len(columns)
+    onConflict := opts.onConflict()
+
+    tx, err := that.Db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, mapContextErr(ctx, err)
+    }
+    defer tx.Rollback()
+
+    var count int64
+    values := make([]interface{}, 0, chunkSize * len(columns))
+    rowNum := 0
+    flush := func() error {
+        if rowNum == 0 {
+            return nil
+        }
+        res, err2 := tx.ExecContext(ctx, buildInsertManySql(table, columns, rowNum, onConflict), values...)
+        if err2 != nil {
+            return err2
+        }
+        affected, err2 := res.RowsAffected()
+        if err2 != nil {
+            return err2
+        }
+        count += affected
+        values = values[:0]
+        rowNum = 0
+        return nil
+    }
+    for rows.Next() {
+        row, err2 := rows.Values()
+        if err2 != nil {
+            return 0, err2
+        }
+        if len(row) != len(columns) {
+            return 0, fmt.Errorf("insert row: %d values for %d columns", len(row), len(columns))
+        }
+        values = append(values, row...)
+        rowNum++
+        if rowNum == chunkSize {
+            if err2 = flush(); err2 != nil {
+                return 0, mapContextErr(ctx, err2)
+            }
+        }
+    }
+    if err2 := rows.Err(); err2 != nil {
+        return 0, err2
+    }
+    if err2 := flush(); err2 != nil {
+        return 0, mapContextErr(ctx, err2)
+    }
+    return count, mapContextErr(ctx, tx.Commit())
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "github.com/lib/pq"
+)
+
+func Test_BuildInsertManySql(t *testing.T) {
+    sql := buildInsertManySql("users", []string{"id", "name"}, 3, "")
+    expected := "INSERT INTO users (id,name) VALUES ($1,$2),($3,$4),($5,$6)"
+    if sql != expected {
+        t.Errorf("wrong sql:\n%s\n%s", sql, expected)
+    }
+    sql = buildInsertManySql("users", []string{"id"}, 2, " ON CONFLICT DO NOTHING")
+    if sql != "INSERT INTO users (id) VALUES ($1),($2) ON CONFLICT DO NOTHING" {
+        t.Errorf("wrong sql with conflict: %s", sql)
+    }
+}
+
+func Test_BulkOnConflict(t *testing.T) {
+    cases := []struct {
+        opts *BulkOptions
+        expected string
+    }{
+        {nil, ""},
+        {&BulkOptions{}, ""},
+        {&BulkOptions{ConflictTarget: "(id)"}, ""},
+        {&BulkOptions{IgnoreConflicts: true}, " ON CONFLICT DO NOTHING"},
+        {&BulkOptions{IgnoreConflicts: true, ConflictTarget: "(id)"}, " ON CONFLICT (id) DO NOTHING"},
+        {&BulkOptions{IgnoreConflicts: true, ConflictTarget: "ON CONSTRAINT users_pkey"}, " ON CONFLICT ON CONSTRAINT users_pkey DO NOTHING"},
+    }
+    for _, c := range cases {
+        if got := c.opts.onConflict(); got != c.expected {
+            t.Errorf("%+v: expected %q, got %q", c.opts, c.expected, got)
+        }
+    }
+}
+
+func Test_CopyInSql(t *testing.T) {
+    if sql := copyInSql("users", []string{"id", "name"}); sql != pq.CopyIn("users", "id", "name") {
+        t.Errorf("wrong copy sql: %s", sql)
+    }
+    if sql := copyInSql("app.users", []string{"id"}); sql != `COPY "app"."users" ("id") FROM STDIN` {
+        t.Errorf("schema should be quoted apart: %s", sql)
+    }
+}
+
+func Test_InsertManyChunks(t *testing.T) {
+    client, d := newFakeClient(t, 0, 0)
+    // 65535 / 16384 = 3 rows per statement
+    columns := make([]string, 16384)
+    for i := range columns {
+        columns[i] = fmt.Sprintf("c%d", i)
+    }
+    rows := make([][]interface{}, 7)
+    for i := range rows {
+        rows[i] = make([]interface{}, len(columns))
+    }
+    n, err := client.InsertMany("t", columns, CopyFromRows(rows), nil)
+    if err != nil || n != 3 {
+        t.Fatalf("should insert in 3 chunks: %d %v", n, err)
+    }
+    var chunks []int
+    for _, exec := range d.execs {
+        if strings.HasPrefix(exec, "INSERT") {
+            chunks = append(chunks, strings.Count(exec, "(") - 1)
+        }
+    }
+    if fmt.Sprint(chunks) != "[3 3 1]" || d.execs[len(d.execs) - 1] != "commit" {
+        t.Errorf("wrong chunks: %v", chunks)
+    }
+
+    // no room for a single row
+    if _, err = client.InsertMany("t", make([]string, maxParams + 1), CopyFromRows(rows), nil); err == nil {
+        t.Error("too many columns should fail")
+    }
+}
+
+func Test_CopyTempTable(t *testing.T) {
+    client, d := newFakeClient(t, 0, 0)
+    opts := &BulkOptions{IgnoreConflicts: true}
+    var temps []string
+    for i := 0; i < 2; i++ {
+        d.execs = nil
+        if _, err := client.CopyFrom("users", []string{"id"}, CopyFromRows([][]interface{}{{1}}), opts); err != nil {
+            t.Fatal(err)
+        }
+        create := d.execs[0]
+        if !strings.HasPrefix(create, "CREATE TEMP TABLE _golib_copy_") {
+            t.Fatalf("should create a temp table: %s", create)
+        }
+        temp := strings.Fields(create)[3]
+        if insert := d.execs[len(d.execs) - 2]; !strings.Contains(insert, "FROM " + temp + " ON CONFLICT DO NOTHING") {
+            t.Errorf("should insert from %s: %s", temp, insert)
+        }
+        temps = append(temps, temp)
+    }
+    if temps[0] == temps[1] {
+        t.Errorf("temp tables should differ per call: %v", temps)
+    }
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+    "container/list"
+    "context"
+    "sync"
+    "time"
+)
+
+// cache backend of query results. values are encoded bytes,
+// so that a shared backend (e.g. redis) can implement it as well.
+type Cache interface {
+    Get(key string) ([]byte, bool)
+    Set(key string, value []byte, ttl time.Duration, tags []string)
+    Delete(key string)
+    InvalidateTags(tags ...string)
+}
+
+// in-memory LRU cache with TTLs and tags
+type MemoryCache struct {
+    mtx sync.Mutex
+    capacity int
+    ll *list.List
+    items map[string]*list.Element
+    tags map[string]map[string]bool  // tag -> keys
+}
+
+type memoryEntry struct {
+    key string
+    value []byte
+    expireAt time.Time  // zero: never
+    tags []string
+}
+
+func NewMemoryCache(capacity int) *MemoryCache {
+    if capacity < 1 {
+        capacity = 1
+    }
+    return &MemoryCache{
+        capacity: capacity,
+        ll: list.New(),
+        items: make(map[string]*list.Element),
+        tags: make(map[string]map[string]bool),
+    }
+}
+
+func (that *MemoryCache) Get(key string) ([]byte, bool) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    elem, ok := that.items[key]
+    if !ok {
+        return nil, false
+    }
+    entry := elem.Value.(*memoryEntry)
+    if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+        that.remove(elem)
+        return nil, false
+    }
+    that.ll.MoveToFront(elem)
+    return entry.value, true
+}
+
+func (that *MemoryCache) Set(key string, value []byte, ttl time.Duration, tags []string) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if elem, ok := that.items[key]; ok {
+        that.remove(elem)
+    }
+    entry := &memoryEntry{key: key, value: value, tags: tags}
+    if ttl > 0 {
+        entry.expireAt = time.Now().Add(ttl)
+    }
+    that.items[key] = that.ll.PushFront(entry)
+    for _, tag := range tags {
+        keys, ok := that.tags[tag]
+        if !ok {
+            keys = make(map[string]bool)
+            that.tags[tag] = keys
+        }
+        keys[key] = true
+    }
+    for that.ll.Len() > that.capacity {
+        that.remove(that.ll.Back())
+    }
+}
+
+func (that *MemoryCache) Delete(key string) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if elem, ok := that.items[key]; ok {
+        that.remove(elem)
+    }
+}
+
+// delete all entries with any of the tags
+func (that *MemoryCache) InvalidateTags(tags ...string) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    for _, tag := range tags {
+        for key := range that.tags[tag] {
+            if elem, ok := that.items[key]; ok {
+                that.remove(elem)
+            }
+        }
+        delete(that.tags, tag)
+    }
+}
+
+func (that *MemoryCache) Len() int {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    return that.ll.Len()
+}
+
+// remove an element. the lock must be held
+func (that *MemoryCache) remove(elem *list.Element) {
+    entry := elem.Value.(*memoryEntry)
+    that.ll.Remove(elem)
+    delete(that.items, entry.key)
+    for _, tag := range entry.tags {
+        if keys, ok := that.tags[tag]; ok {
+            delete(keys, entry.key)
+            if len(keys) == 0 {
+                delete(that.tags, tag)
+            }
+        }
+    }
+}
+
+// single flight: concurrent calls of the same key share one execution.
+// it runs on its own goroutine, so a caller giving up doesn't fail the others
+type flightCall struct {
+    done chan bool
+    value []byte
+    err error
+}
+
+type flightGroup struct {
+    mtx sync.Mutex
+    calls map[string]*flightCall
+}
+
+func (that *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+    that.mtx.Lock()
+    if that.calls == nil {
+        that.calls = make(map[string]*flightCall)
+    }
+    call, ok := that.calls[key]
+    if !ok {
+        call = &flightCall{done: make(chan bool)}
+        that.calls[key] = call
+        go func(){
+            call.value, call.err = fn()
+            that.mtx.Lock()
+            delete(that.calls, key)
+            that.mtx.Unlock()
+            close(call.done)
+        }()
+    }
+    that.mtx.Unlock()
+    select {
+    case <-call.done:
+        return call.value, call.err
+    case <-ctx.Done():
+        return nil, mapContextErr(ctx, ctx.Err())
+    }
+}
+
+// a context with the values of its parent, but not its cancellation and deadline
+type detachedCtx struct {
+    context.Context
+}
+
+func (that detachedCtx) Deadline() (time.Time, bool) {
+    return time.Time{}, false
+}
+
+func (that detachedCtx) Done() <-chan struct{} {
+    return nil
+}
+
+func (that detachedCtx) Err() error {
+    return nil
+}
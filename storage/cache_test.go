@@ -0,0 +1,157 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func Test_MemoryCache(t *testing.T) {
+
+    cache := NewMemoryCache(2)
+    cache.Set("a", []byte("1"), 0, []string{"users"})
+    cache.Set("b", []byte("2"), 0, []string{"orders"})
+    if v, ok := cache.Get("a"); !ok || string(v) != "1" {
+        t.Error("should get a")
+    }
+    // b is the least recently used
+    cache.Set("c", []byte("3"), 0, []string{"users"})
+    if _, ok := cache.Get("b"); ok {
+        t.Error("b should be evicted")
+    }
+    // ttl
+    cache.Set("d", []byte("4"), time.Millisecond, nil)
+    time.Sleep(5 * time.Millisecond)
+    if _, ok := cache.Get("d"); ok {
+        t.Error("d should be expired")
+    }
+    // tags
+    cache.Set("a", []byte("1"), 0, []string{"users"})
+    cache.Set("c", []byte("3"), 0, []string{"users"})
+    cache.InvalidateTags("users")
+    if cache.Len() != 0 {
+        t.Errorf("entries tagged users should be invalidated, %d left", cache.Len())
+    }
+}
+
+func Test_CachedClientSingleFlight(t *testing.T) {
+
+    client, d := newFakeClient(t, -1, 20 * time.Millisecond)
+    cached := NewCachedClient(client, NewMemoryCache(100), time.Minute)
+    opts := CacheOptions{Tags: []string{"numbers"}}
+
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(){
+            defer wg.Done()
+            var n int64
+            found, err := cached.SelectOne(opts, "select n from numbers where id = ?", FieldMapping{"n": &n}, 1)
+            if err != nil || found != 1 || n != 1 {
+                t.Errorf("wrong result: found=%d n=%d err=%v", found, n, err)
+            }
+        }()
+    }
+    wg.Wait()
+    if n := atomic.LoadInt64(&d.prepares); n != 1 {
+        t.Errorf("concurrent misses should query once, got %d", n)
+    }
+
+    // other args
+    var n int64
+    cached.SelectOne(opts, "select n from numbers where id = ?", FieldMapping{"n": &n}, 2)
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("different args should miss, got %d queries", n)
+    }
+
+    // page
+    type item struct {
+        N int64
+    }
+    doMapping := func() (interface{}, map[string]interface{}) {
+        ptr := new(item)
+        return ptr, map[string]interface{}{"n": &ptr.N}
+    }
+    for i := 0; i < 2; i++ {
+        info, list, err := cached.SelectPage(opts, "select n from numbers", 1, 10, doMapping)
+        if err != nil || info.Total != 1 || len(list) != 1 || list[0].(*item).N != 1 {
+            t.Errorf("wrong page: %+v %v %v", info, list, err)
+        }
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 4 {
+        t.Errorf("cached page should not query again, got %d queries", n)
+    }
+
+    // invalidate
+    cached.Invalidate("numbers")
+    cached.SelectOne(opts, "select n from numbers where id = ?", FieldMapping{"n": &n}, 1)
+    if n := atomic.LoadInt64(&d.prepares); n != 5 {
+        t.Errorf("invalidated result should be queried again, got %d queries", n)
+    }
+}
+
+func Test_CachedClientInvalidateDuringLoad(t *testing.T) {
+    client, d := newFakeClient(t, -1, 50 * time.Millisecond)
+    cached := NewCachedClient(client, NewMemoryCache(100), time.Minute)
+    opts := CacheOptions{Tags: []string{"numbers"}}
+    query := func() {
+        var n int64
+        if found, err := cached.SelectOne(opts, "select n from numbers", FieldMapping{"n": &n}); err != nil || found != 1 {
+            t.Errorf("wrong result: %d %v", found, err)
+        }
+    }
+    done := make(chan bool)
+    go func() {
+        query()
+        close(done)
+    }()
+    time.Sleep(10 * time.Millisecond)
+    // the write lands while the old result is loading
+    cached.Invalidate("numbers")
+    <-done
+    query()
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("a load overlapping the invalidation should not be cached, got %d queries", n)
+    }
+    query()
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("a load after the invalidation should be cached, got %d queries", n)
+    }
+}
+
+func Test_CachedClientLeaderCanceled(t *testing.T) {
+    client, d := newFakeClient(t, -1, 50 * time.Millisecond)
+    cached := NewCachedClient(client, NewMemoryCache(100), time.Minute)
+    opts := CacheOptions{Tags: []string{"numbers"}}
+    ctx, cancel := context.WithCancel(context.Background())
+    leader := make(chan error)
+    go func() {
+        var n int64
+        _, err := cached.SelectOneContext(ctx, opts, "select n from numbers", FieldMapping{"n": &n})
+        leader <- err
+    }()
+    time.Sleep(10 * time.Millisecond)
+    waiter := make(chan error)
+    go func() {
+        var n int64
+        found, err := cached.SelectOne(opts, "select n from numbers", FieldMapping{"n": &n})
+        if err == nil && (found != 1 || n != 1) {
+            err = errors.New("wrong result")
+        }
+        waiter <- err
+    }()
+    time.Sleep(10 * time.Millisecond)
+    cancel()
+    if err := <-leader; !errors.Is(err, ErrQueryCanceled) {
+        t.Errorf("leader should be canceled, got %v", err)
+    }
+    if err := <-waiter; err != nil {
+        t.Errorf("waiter should get the shared load: %v", err)
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 1 {
+        t.Errorf("should query once, got %d", n)
+    }
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "sort"
+    "sync"
+    "time"
+)
+
+/*
+query result caching in front of PgClient reads
+
+results are stored as JSON: SelectOne values are decoded into the addresses of src,
+SelectPage items are decoded into the pointers returned by doMapping, so their fields must be JSON-exported.
+
+usage:
+  cached := storage.NewCachedClient(client, storage.NewMemoryCache(10000), time.Minute)
+  n, err := cached.SelectOne(storage.CacheOptions{Tags: []string{"users"}}, "select name from users where id = ?", src, id)
+  ...
+  // after writing users
+  cached.Invalidate("users")
+*/
+
+type CacheOptions struct {
+    TTL time.Duration  // 0: the client's default TTL
+    Tags []string      // for invalidation
+}
+
+type CachedClient struct {
+    Client *PgClient
+    Cache Cache
+    TTL time.Duration  // default TTL
+    group flightGroup
+    mtx sync.RWMutex
+    epochs map[string]uint64  // tag -> number of invalidations, guarded by mtx
+}
+
+func NewCachedClient(client *PgClient, cache Cache, ttl time.Duration) *CachedClient {
+    return &CachedClient{Client: client, Cache: cache, TTL: ttl}
+}
+
+// key: hash of the rewritten sql and args
+func (that *CachedClient) key(kind string, sql string, extra []interface{}, values []interface{}) (string, error) {
+    args, err := json.Marshal([]interface{}{extra, values})
+    if err != nil {
+        return "", err
+    }
+    h := sha256.New()
+    h.Write([]byte(kind))
+    h.Write([]byte{0})
+    h.Write([]byte(that.Client.BuildSql(sql)))
+    h.Write([]byte{0})
+    h.Write(args)
+    return "pgcache:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// the sum of the epochs of tags, it changes with any invalidation of them. the lock must be held
+func (that *CachedClient) generation(tags []string) uint64 {
+    var sum uint64
+    for _, tag := range tags {
+        sum += that.epochs[tag]
+    }
+    return sum
+}
+
+// get from cache, or load once for concurrent misses and store the result.
+// the load runs detached from ctx, so the caller that started it can't fail the others by giving up.
+// a load overlapping an Invalidate of its tags, on this client, is returned but not cached
+func (that *CachedClient) fetch(ctx context.Context, key string, opts CacheOptions, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+    if value, ok := that.Cache.Get(key); ok {
+        return value, nil
+    }
+    that.mtx.RLock()
+    generation := that.generation(opts.Tags)
+    that.mtx.RUnlock()
+    // a miss after an invalidation doesn't join a flight started before it
+    return that.group.do(ctx, fmt.Sprintf("%s@%d", key, generation), func() ([]byte, error) {
+        // filled by a flight finished meanwhile
+        if value, ok := that.Cache.Get(key); ok {
+            return value, nil
+        }
+        value, err := load(detachedCtx{ctx})
+        if err != nil {
+            return nil, err
+        }
+        ttl := opts.TTL
+        if ttl <= 0 {
+            ttl = that.TTL
+        }
+        that.mtx.RLock()
+        defer that.mtx.RUnlock()
+        if that.generation(opts.Tags) == generation {
+            that.Cache.Set(key, value, ttl, opts.Tags)
+        }
+        return value, nil
+    })
+}
+
+// delete cached results with any of the tags
+func (that *CachedClient) Invalidate(tags ...string) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if that.epochs == nil {
+        that.epochs = make(map[string]uint64)
+    }
+    for _, tag := range tags {
+        that.epochs[tag]++
+    }
+    that.Cache.InvalidateTags(tags...)
+}
+
+type cachedOne struct {
+    Found int `json:"found"`
+    Fields map[string]json.RawMessage `json:"fields"`
+}
+
+func (that *CachedClient) SelectOne(opts CacheOptions, sql string, src FieldMapping, values ...interface{}) (int, error) {
+    return that.SelectOneContext(context.Background(), opts, sql, src, values...)
+}
+
+func (that *CachedClient) SelectOneContext(ctx context.Context, opts CacheOptions, sql string, src FieldMapping, values ...interface{}) (int, error) {
+    // fields are part of the key, different src may pick different columns
+    fields := make([]string, 0, len(src))
+    for name := range src {
+        fields = append(fields, name)
+    }
+    sort.Strings(fields)
+    key, err := that.key("one", sql, []interface{}{fields}, values)
+    if err != nil {
+        return 0, err
+    }
+    data, err := that.fetch(ctx, key, opts, func(ctx context.Context) ([]byte, error) {
+        // scan into fresh variables of the same types
+        holder := make(FieldMapping, len(src))
+        for name, addr := range src {
+            holder[name] = reflect.New(reflect.TypeOf(addr).Elem()).Interface()
+        }
+        n, err := that.Client.SelectOneContext(ctx, sql, holder, values...)
+        if err != nil {
+            return nil, err
+        }
+        result := cachedOne{n, make(map[string]json.RawMessage)}
+        if n > 0 {
+            for name, addr := range holder {
+                if result.Fields[name], err = json.Marshal(addr); err != nil {
+                    return nil, err
+                }
+            }
+        }
+        return json.Marshal(result)
+    })
+    if err != nil {
+        return 0, err
+    }
+    var result cachedOne
+    if err := json.Unmarshal(data, &result); err != nil {
+        return 0, err
+    }
+    for name, raw := range result.Fields {
+        if addr, ok := src[name]; ok {
+            if err := json.Unmarshal(raw, addr); err != nil {
+                return 0, err
+            }
+        }
+    }
+    return result.Found, nil
+}
+
+type cachedPage struct {
+    Info PageInfo `json:"info"`
+    List []json.RawMessage `json:"list"`
+}
+
+func (that *CachedClient) SelectPage(opts CacheOptions, sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
+    return that.SelectPageContext(context.Background(), opts, sql, page, limit, doMapping, values...)
+}
+
+func (that *CachedClient) SelectPageContext(ctx context.Context, opts CacheOptions, sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
+    pageInfo := PageInfo{0, page, limit}
+    key, err := that.key("page", sql, []interface{}{page, limit}, values)
+    if err != nil {
+        return pageInfo, nil, err
+    }
+    data, err := that.fetch(ctx, key, opts, func(ctx context.Context) ([]byte, error) {
+        info, list, err := that.Client.SelectPageContext(ctx, sql, page, limit, doMapping, values...)
+        if err != nil {
+            return nil, err
+        }
+        result := cachedPage{info, make([]json.RawMessage, len(list))}
+        for i, item := range list {
+            if result.List[i], err = json.Marshal(item); err != nil {
+                return nil, err
+            }
+        }
+        return json.Marshal(result)
+    })
+    if err != nil {
+        return pageInfo, nil, err
+    }
+    var result cachedPage
+    if err := json.Unmarshal(data, &result); err != nil {
+        return pageInfo, nil, err
+    }
+    var list []interface{}
+    for _, raw := range result.List {
+        ptr, _ := doMapping()
+        if ptr == nil {
+            return result.Info, list, errors.New("SelectPage err: ptr is nil")
+        }
+        if err := json.Unmarshal(raw, ptr); err != nil {
+            return result.Info, list, err
+        }
+        list = append(list, ptr)
+    }
+    return result.Info, list, nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// read/write splitting
+// reads go to healthy replicas, writes and transactions go to the primary.
+// every node keeps its own heartbeat, unavailable replicas are skipped until they recover.
+
+const (
+    RoundRobin = "round-robin"
+    LeastLatency = "least-latency"
+)
+
+type PgCluster struct {
+    Primary *PgClient
+    Replicas []*PgClient
+    Strategy string  // RoundRobin(default) or LeastLatency
+    ReadAfterWrite time.Duration  // reads go to the primary within this duration after a write, 0: disabled
+    next uint64
+    lastWrite int64  // unix nano
+}
+
+type forcePrimaryKey struct{}
+
+// reads with the returned context go to the primary
+func ForcePrimary(ctx context.Context) context.Context {
+    return context.WithValue(ctx, forcePrimaryKey{}, true)
+}
+
+/*
+load cluster from env variables:
+  the primary is configured the same way as PgConfigFromEnv
+  pg_replica_urls         comma separated url DSNs of replicas
+  pg_read_strategy        round-robin(default), least-latency
+  pg_read_after_write     e.g. 2s, or seconds
+*/
+func PgClusterFromEnv() (*PgCluster, error) {
+    config, err := PgConfigFromEnv()
+    if err != nil {
+        return nil, err
+    }
+    cluster := &PgCluster{
+        Primary: NewPgClient(config),
+        Strategy: os.Getenv("pg_read_strategy"),
+    }
+    if cluster.ReadAfterWrite, err = parseDuration(os.Getenv("pg_read_after_write")); err != nil {
+        return nil, err
+    }
+    for _, dsn := range strings.Split(os.Getenv("pg_replica_urls"), ",") {
+        if dsn = strings.TrimSpace(dsn); dsn == "" {
+            continue
+        }
+        replicaConfig, err2 := ParsePgUrl(dsn)
+        if err2 != nil {
+            return nil, err2
+        }
+        cluster.Replicas = append(cluster.Replicas, NewPgClient(replicaConfig))
+    }
+    return cluster, nil
+}
+
+// open all nodes
+func (that *PgCluster) Open() {
+    that.Primary.Open()
+    for _, replica := range that.Replicas {
+        replica.Open()
+    }
+}
+
+func (that *PgCluster) Close() {
+    that.Primary.Close()
+    for _, replica := range that.Replicas {
+        replica.Close()
+    }
+}
+
+func (that *PgCluster) wrote() {
+    if that.ReadAfterWrite > 0 {
+        atomic.StoreInt64(&that.lastWrite, time.Now().UnixNano())
+    }
+}
+
+// node for writing
+func (that *PgCluster) Writer() *PgClient {
+    return that.Primary
+}
+
+// node for reading: a healthy replica, or the primary when none is available
+func (that *PgCluster) Reader(ctx context.Context) *PgClient {
+    if force, _ := ctx.Value(forcePrimaryKey{}).(bool); force {
+        return that.Primary
+    }
+    if that.ReadAfterWrite > 0 {
+        lastWrite := atomic.LoadInt64(&that.lastWrite)
+        if time.Now().UnixNano() - lastWrite < that.ReadAfterWrite.Nanoseconds() {
+            return that.Primary
+        }
+    }
+    n := len(that.Replicas)
+    if n == 0 {
+        return that.Primary
+    }
+    if that.Strategy == LeastLatency {
+        var best *PgClient
+        var bestLatency time.Duration
+        for _, replica := range that.Replicas {
+            if health := replica.Health(); health.Available && (best == nil || health.Latency < bestLatency) {
+                best, bestLatency = replica, health.Latency
+            }
+        }
+        if best != nil {
+            return best
+        }
+        return that.Primary
+    }
+    // round robin, skip unavailable ones
+    start := atomic.AddUint64(&that.next, 1)
+    for i := 0; i < n; i++ {
+        replica := that.Replicas[(start + uint64(i)) % uint64(n)]
+        if replica.Available() {
+            return replica
+        }
+    }
+    return that.Primary
+}
+
+// reads
+func (that *PgCluster) Query(sql string, values ...interface{}) (*sql.Rows, error){
+    return that.QueryContext(context.Background(), sql, values...)
+}
+
+func (that *PgCluster) QueryContext(ctx context.Context, sql string, values ...interface{}) (*sql.Rows, error){
+    return that.Reader(ctx).QueryContext(ctx, sql, values...)
+}
+
+func (that *PgCluster) QueryRow(sql string, values ...interface{}) (*sql.Row, error){
+    return that.QueryRowContext(context.Background(), sql, values...)
+}
+
+func (that *PgCluster) QueryRowContext(ctx context.Context, sql string, values ...interface{}) (*sql.Row, error){
+    return that.Reader(ctx).QueryRowContext(ctx, sql, values...)
+}
+
+func (that *PgCluster) SelectOne(sql string, src FieldMapping, values ...interface{}) (int, error) {
+    return that.SelectOneContext(context.Background(), sql, src, values...)
+}
+
+func (that *PgCluster) SelectOneContext(ctx context.Context, sql string, src FieldMapping, values ...interface{}) (int, error) {
+    return that.Reader(ctx).SelectOneContext(ctx, sql, src, values...)
+}
+
+func (that *PgCluster) SelectPage(sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
+    return that.SelectPageContext(context.Background(), sql, page, limit, doMapping, values...)
+}
+
+func (that *PgCluster) SelectPageContext(ctx context.Context, sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
+    return that.Reader(ctx).SelectPageContext(ctx, sql, page, limit, doMapping, values...)
+}
+
+func (that *PgCluster) SelectCursorPage(sql string, opts CursorOptions, cursor string, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (CursorPageInfo, []interface{}, error){
+    return that.SelectCursorPageContext(context.Background(), sql, opts, cursor, doMapping, values...)
+}
+
+func (that *PgCluster) SelectCursorPageContext(ctx context.Context, sql string, opts CursorOptions, cursor string, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (CursorPageInfo, []interface{}, error){
+    return that.Reader(ctx).SelectCursorPageContext(ctx, sql, opts, cursor, doMapping, values...)
+}
+
+// writes
+func (that *PgCluster) Insert(table string, fields map[string]interface{}, returning string, src interface{}) (error){
+    return that.InsertContext(context.Background(), table, fields, returning, src)
+}
+
+func (that *PgCluster) InsertContext(ctx context.Context, table string, fields map[string]interface{}, returning string, src interface{}) (error){
+    defer that.wrote()
+    return that.Primary.InsertContext(ctx, table, fields, returning, src)
+}
+
+func (that *PgCluster) Update(table string, fields map[string]interface{}, where string, vars ...interface{}) (int64, error){
+    return that.UpdateContext(context.Background(), table, fields, where, vars...)
+}
+
+func (that *PgCluster) UpdateContext(ctx context.Context, table string, fields map[string]interface{}, where string, vars ...interface{}) (int64, error){
+    defer that.wrote()
+    return that.Primary.UpdateContext(ctx, table, fields, where, vars...)
+}
+
+func (that *PgCluster) Exec(sql string, values ...interface{}) (int64, error){
+    return that.ExecContext(context.Background(), sql, values...)
+}
+
+func (that *PgCluster) ExecContext(ctx context.Context, sql string, values ...interface{}) (int64, error){
+    defer that.wrote()
+    return that.Primary.ExecContext(ctx, sql, values...)
+}
+
+// transactions always run on the primary
+func (that *PgCluster) Begin() (*sql.Tx, error){
+    return that.BeginTx(context.Background(), nil)
+}
+
+func (that *PgCluster) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error){
+    defer that.wrote()
+    tx, err := that.Primary.Db.BeginTx(ctx, opts)
+    return tx, mapContextErr(ctx, err)
+}
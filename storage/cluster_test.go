@@ -0,0 +1,52 @@
+package storage
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+func Test_ClusterReader(t *testing.T) {
+
+    primary, replica1, replica2 := new(PgClient), new(PgClient), new(PgClient)
+    cluster := &PgCluster{Primary: primary, Replicas: []*PgClient{replica1, replica2}}
+    ctx := context.Background()
+
+    // no healthy replica
+    if cluster.Reader(ctx) != primary {
+        t.Error("should read from primary when no replica is available")
+    }
+
+    // round robin
+    replica1.recordCheck(nil, 5 * time.Millisecond)
+    replica2.recordCheck(nil, time.Millisecond)
+    first, second := cluster.Reader(ctx), cluster.Reader(ctx)
+    if first == second || first == primary || second == primary {
+        t.Error("should read from replicas in turn")
+    }
+    // eject
+    replica1.recordCheck(errors.New("down"), 0)
+    for i := 0; i < 3; i++ {
+        if cluster.Reader(ctx) != replica2 {
+            t.Error("unavailable replica should be skipped")
+        }
+    }
+    // re-admit, least latency
+    replica1.recordCheck(nil, 5 * time.Millisecond)
+    cluster.Strategy = LeastLatency
+    if cluster.Reader(ctx) != replica2 {
+        t.Error("should read from the replica with least latency")
+    }
+
+    // forced
+    if cluster.Reader(ForcePrimary(ctx)) != primary {
+        t.Error("should read from primary when forced")
+    }
+    // after write
+    cluster.ReadAfterWrite = time.Minute
+    cluster.wrote()
+    if cluster.Reader(ctx) != primary {
+        t.Error("should read from primary after a write")
+    }
+}
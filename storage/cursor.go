@@ -0,0 +1,279 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "strings"
+    "sync"
+)
+
+// keyset (cursor) pagination
+// 基于有序键列分页, 不使用offset, 翻页结果不受并发插入影响
+
+var ErrInvalidCursor = errors.New("err: invalid cursor")
+
+const (
+    cursorNext = "n"
+    cursorPrev = "p"
+)
+
+// default secret for signing cursors. env: pg_cursor_secret
+// without it a random secret is used, and cursors can't be shared between processes
+var cursorSecretOnce sync.Once
+var defaultCursorSecret []byte
+
+func getDefaultCursorSecret() []byte {
+    cursorSecretOnce.Do(func(){
+        if secret := os.Getenv("pg_cursor_secret"); secret != "" {
+            defaultCursorSecret = []byte(secret)
+        }else{
+            buf := make([]byte, 32)
+            rand.Read(buf)
+            defaultCursorSecret = []byte(hex.EncodeToString(buf))
+        }
+    })
+    return defaultCursorSecret
+}
+
+func (that *PgClient) cursorSecret() []byte {
+    if that.CursorSecret != "" {
+        return []byte(that.CursorSecret)
+    }
+    return getDefaultCursorSecret()
+}
+
+type CursorOptions struct {
+    Keys []string    // ordered key columns, unique together. e.g. []string{"created_at", "id"}
+    Desc bool        // order direction of all keys
+    Limit int64      // page size
+    WithTotal bool   // also run count(1). Total is -1 when skipped
+}
+
+// fits into web.Success, e.g. web.Success(c, gin.H{"page": info, "list": list})
+type CursorPageInfo struct {
+    Next string `json:"next"`   // empty on the last page
+    Prev string `json:"prev"`   // empty on the first page
+    Limit int64 `json:"limit"`
+    Total int64 `json:"total"`
+}
+
+type cursorToken struct {
+    Dir string `json:"d"`
+    Keys []interface{} `json:"k"`
+}
+
+// cursor token: base64(payload).base64(hmac-sha256(payload))
+func encodeCursor(secret []byte, dir string, keys []interface{}) (string, error) {
+    payload, err := json.Marshal(cursorToken{dir, keys})
+    if err != nil {
+        return "", err
+    }
+    mac := hmac.New(sha256.New, secret)
+    mac.Write(payload)
+    return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodeCursor(secret []byte, cursor string) (*cursorToken, error) {
+    parts := strings.Split(cursor, ".")
+    if len(parts) != 2 {
+        return nil, ErrInvalidCursor
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    mac := hmac.New(sha256.New, secret)
+    mac.Write(payload)
+    if !hmac.Equal(sig, mac.Sum(nil)) {
+        return nil, ErrInvalidCursor
+    }
+    token := new(cursorToken)
+    decoder := json.NewDecoder(bytes.NewReader(payload))
+    decoder.UseNumber()
+    if err := decoder.Decode(token); err != nil {
+        return nil, ErrInvalidCursor
+    }
+    if token.Dir != cursorNext && token.Dir != cursorPrev {
+        return nil, ErrInvalidCursor
+    }
+    return token, nil
+}
+
+// build keyset sql. keys are compared as a row: (k1, k2) > (?, ?)
+// backward pages are read in reverse order and flipped after scanning
+func buildCursorSql(sql string, opts CursorOptions, token *cursorToken) string {
+    backward := token != nil && token.Dir == cursorPrev
+    // desc XOR backward
+    desc := opts.Desc != backward
+    order := "asc"
+    cmp := ">"
+    if desc {
+        order = "desc"
+        cmp = "<"
+    }
+    keys := strings.Join(opts.Keys, ",")
+    orders := make([]string, len(opts.Keys))
+    for i, key := range opts.Keys {
+        orders[i] = key + " " + order
+    }
+    where := ""
+    if token != nil {
+        placeholders := make([]string, len(opts.Keys))
+        for i := range placeholders {
+            placeholders[i] = "?"
+        }
+        where = fmt.Sprintf(" where (%s) %s (%s)", keys, cmp, strings.Join(placeholders, ","))
+    }
+    // the limit is bound as the last parameter, so that every page shares one prepared statement
+    return fmt.Sprintf("select * from (%s) _cursor%s order by %s limit ?", sql, where, strings.Join(orders, ","))
+}
+
+// scan a row by mapping, and pick the values of key columns
+func cursorScan(rows *sql.Rows, mapping map[string]interface{}, keys []string) ([]interface{}, error) {
+    cols, err := rows.Columns()
+    if err != nil {
+        return nil, err
+    }
+    pointers, values := makePointers(len(cols))
+    for i, name := range cols {
+        if addr, ok := mapping[name]; ok {
+            pointers[i] = addr
+        }
+    }
+    if err2 := rows.Scan(pointers...); err2 != nil {
+        return nil, err2
+    }
+    keyValues := make([]interface{}, len(keys))
+    for k, key := range keys {
+        found := false
+        for i, name := range cols {
+            if name != key {
+                continue
+            }
+            found = true
+            if addr, ok := mapping[name]; ok {
+                keyValues[k] = reflect.ValueOf(addr).Elem().Interface()
+            }else{
+                keyValues[k] = values[i]
+            }
+            // sql.NullString etc.
+            if valuer, ok := keyValues[k].(driver.Valuer); ok {
+                if keyValues[k], err = valuer.Value(); err != nil {
+                    return nil, err
+                }
+            }
+            break
+        }
+        if !found {
+            return nil, errors.New("cursor key not selected: " + key)
+        }
+    }
+    return keyValues, nil
+}
+
+// select a page by keyset. cursor is the Next or Prev of the previous page, empty for the first page.
+func (that *PgClient) SelectCursorPage(sql string, opts CursorOptions, cursor string, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (CursorPageInfo, []interface{}, error){
+    return that.SelectCursorPageContext(context.Background(), sql, opts, cursor, doMapping, values...)
+}
+
+func (that *PgClient) SelectCursorPageContext(ctx context.Context, sql string, opts CursorOptions, cursor string, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (CursorPageInfo, []interface{}, error){
+    pageInfo := CursorPageInfo{"", "", opts.Limit, -1}
+    if len(opts.Keys) == 0 || opts.Limit < 1 {
+        return pageInfo, nil, errors.New("SelectCursorPage err: keys and limit are required")
+    }
+    secret := that.cursorSecret()
+    var token *cursorToken
+    if cursor != "" {
+        var err error
+        if token, err = decodeCursor(secret, cursor); err != nil {
+            return pageInfo, nil, err
+        }
+        if len(token.Keys) != len(opts.Keys) {
+            return pageInfo, nil, ErrInvalidCursor
+        }
+    }
+    // count
+    if opts.WithTotal {
+        countSql := fmt.Sprintf("select count(1) as total from (%s) _alias", sql)
+        if row, err := that.QueryRowContext(ctx, countSql, values...); err != nil {
+            return pageInfo, nil, err
+        }else{
+            if err2 := row.Scan(&pageInfo.Total); err2 != nil {
+                return pageInfo, nil, mapContextErr(ctx, err2)
+            }
+        }
+    }
+    // get page
+    pageSql := buildCursorSql(sql, opts, token)
+    args := append([]interface{}{}, values...)
+    if token != nil {
+        args = append(args, token.Keys...)
+    }
+    args = append(args, opts.Limit + 1)
+    rows, err := that.QueryContext(ctx, pageSql, args...)
+    if err != nil {
+        return pageInfo, nil, err
+    }
+    defer rows.Close()
+    var list []interface{}
+    var keyList [][]interface{}
+    for rows.Next() {
+        ptr, mapping := doMapping()
+        if ptr == nil || mapping == nil {
+            return pageInfo, list, errors.New("SelectCursorPage err: ptr or mapping is nil")
+        }
+        keyValues, err2 := cursorScan(rows, mapping, opts.Keys)
+        if err2 != nil {
+            return pageInfo, list, err2
+        }
+        list = append(list, ptr)
+        keyList = append(keyList, keyValues)
+    }
+    if err3 := rows.Err(); err3 != nil {
+        return pageInfo, list, mapContextErr(ctx, err3)
+    }
+    hasMore := int64(len(list)) > opts.Limit
+    if hasMore {
+        list = list[:opts.Limit]
+        keyList = keyList[:opts.Limit]
+    }
+    backward := token != nil && token.Dir == cursorPrev
+    if backward {
+        for i, j := 0, len(list) - 1; i < j; i, j = i + 1, j - 1 {
+            list[i], list[j] = list[j], list[i]
+            keyList[i], keyList[j] = keyList[j], keyList[i]
+        }
+    }
+    if len(list) == 0 {
+        return pageInfo, list, nil
+    }
+    // there are rows after the last one
+    if hasMore || backward {
+        if pageInfo.Next, err = encodeCursor(secret, cursorNext, keyList[len(keyList) - 1]); err != nil {
+            return pageInfo, list, err
+        }
+    }
+    // there are rows before the first one
+    if backward && hasMore || !backward && token != nil {
+        if pageInfo.Prev, err = encodeCursor(secret, cursorPrev, keyList[0]); err != nil {
+            return pageInfo, list, err
+        }
+    }
+    return pageInfo, list, nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func Test_CursorToken(t *testing.T) {
+
+    secret := []byte("secret")
+    cursor, err := encodeCursor(secret, cursorNext, []interface{}{"2017-01-01T00:00:00Z", 42})
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, err := decodeCursor(secret, cursor)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if token.Dir != cursorNext || len(token.Keys) != 2 {
+        t.Error("wrong token decoded")
+    }
+    if n, ok := token.Keys[1].(json.Number); !ok || n.String() != "42" {
+        t.Error("number key should be decoded as json.Number")
+    }
+
+    // wrong secret
+    if _, err := decodeCursor([]byte("other"), cursor); err != ErrInvalidCursor {
+        t.Error("cursor signed by other secret should be rejected")
+    }
+    // tampered payload
+    forged, _ := encodeCursor([]byte("other"), cursorNext, []interface{}{"2017-01-01T00:00:00Z", 43})
+    if _, err := decodeCursor(secret, forged[:len(forged) - 1] + "A"); err != ErrInvalidCursor {
+        t.Error("tampered cursor should be rejected")
+    }
+    if _, err := decodeCursor(secret, "garbage"); err != ErrInvalidCursor {
+        t.Error("garbage cursor should be rejected")
+    }
+}
+
+func Test_BuildCursorSql(t *testing.T) {
+
+    opts := CursorOptions{Keys: []string{"created_at", "id"}, Limit: 10}
+    sql := "select * from t where owner = ?"
+
+    first := buildCursorSql(sql, opts, nil)
+    if first != "select * from (select * from t where owner = ?) _cursor order by created_at asc,id asc limit ?" {
+        t.Error("wrong first page sql: " + first)
+    }
+    next := buildCursorSql(sql, opts, &cursorToken{cursorNext, nil})
+    if next != "select * from (select * from t where owner = ?) _cursor where (created_at,id) > (?,?) order by created_at asc,id asc limit ?" {
+        t.Error("wrong next page sql: " + next)
+    }
+    prev := buildCursorSql(sql, opts, &cursorToken{cursorPrev, nil})
+    if prev != "select * from (select * from t where owner = ?) _cursor where (created_at,id) < (?,?) order by created_at desc,id desc limit ?" {
+        t.Error("wrong prev page sql: " + prev)
+    }
+    opts.Desc = true
+    descPrev := buildCursorSql(sql, opts, &cursorToken{cursorPrev, nil})
+    if descPrev != "select * from (select * from t where owner = ?) _cursor where (created_at,id) > (?,?) order by created_at asc,id asc limit ?" {
+        t.Error("wrong desc prev page sql: " + descPrev)
+    }
+}
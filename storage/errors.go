@@ -0,0 +1,149 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "net"
+    "strings"
+    "github.com/lib/pq"
+)
+
+// typed errors
+// helpers classify errors from PgClient by the postgresql error codes of lib/pq
+
+var (
+    ErrQueryCanceled = errors.New("err: query canceled")
+    ErrQueryTimeout = errors.New("err: query timeout")
+    ErrNotFound = errors.New("err: not found")
+)
+
+// postgresql error codes
+const (
+    CodeUniqueViolation = "23505"
+    CodeForeignKeyViolation = "23503"
+    CodeNotNullViolation = "23502"
+    CodeCheckViolation = "23514"
+    CodeSerializationFailure = "40001"
+    CodeDeadlockDetected = "40P01"
+    CodeQueryCanceled = "57014"
+    CodeFeatureNotSupported = "0A000"
+    CodeAdminShutdown = "57P01"
+    CodeCannotConnectNow = "57P03"
+    CodeTooManyConnections = "53300"
+)
+
+// a driver error classified as ErrQueryCanceled or ErrQueryTimeout.
+// errors.Is matches the class, errors.As still finds the driver error, e.g. *pq.Error
+type queryError struct {
+    kind error
+    err error
+}
+
+func (that *queryError) Error() string {
+    return that.kind.Error() + ": " + that.err.Error()
+}
+
+func (that *queryError) Is(target error) bool {
+    return target == that.kind
+}
+
+func (that *queryError) Unwrap() error {
+    return that.err
+}
+
+// wrap cancellations with ErrQueryCanceled / ErrQueryTimeout, keeping the driver error
+func mapContextErr(ctx context.Context, err error) error {
+    if err == nil {
+        return nil
+    }
+    switch {
+    case errors.Is(err, ErrQueryCanceled) || errors.Is(err, ErrQueryTimeout):
+        // wrapped already
+        return err
+    case ctx.Err() == context.Canceled || errors.Is(err, context.Canceled):
+        return &queryError{ErrQueryCanceled, err}
+    case ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded):
+        return &queryError{ErrQueryTimeout, err}
+    }
+    // 57014 query_canceled, raised by statement_timeout, but also by pg_cancel_backend
+    if pqErr := asPqError(err); pqErr != nil && pqErr.Code == CodeQueryCanceled {
+        if strings.Contains(pqErr.Message, "statement timeout") {
+            return &queryError{ErrQueryTimeout, err}
+        }
+        return &queryError{ErrQueryCanceled, err}
+    }
+    return err
+}
+
+func asPqError(err error) *pq.Error {
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) {
+        return pqErr
+    }
+    return nil
+}
+
+// postgresql error code (SQLSTATE), empty for other errors
+func ErrorCode(err error) string {
+    if pqErr := asPqError(err); pqErr != nil {
+        return string(pqErr.Code)
+    }
+    return ""
+}
+
+// name of the violated constraint, empty for other errors
+func ConstraintName(err error) string {
+    if pqErr := asPqError(err); pqErr != nil {
+        return pqErr.Constraint
+    }
+    return ""
+}
+
+func IsUniqueViolation(err error) bool {
+    return ErrorCode(err) == CodeUniqueViolation
+}
+
+func IsForeignKeyViolation(err error) bool {
+    return ErrorCode(err) == CodeForeignKeyViolation
+}
+
+// a constraint violated by the input: not null, check or foreign key
+func IsInvalidInput(err error) bool {
+    switch ErrorCode(err) {
+    case CodeNotNullViolation, CodeCheckViolation, CodeForeignKeyViolation:
+        return true
+    }
+    return false
+}
+
+// no row: sql.ErrNoRows or ErrNotFound
+func IsNotFound(err error) bool {
+    return errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrNotFound)
+}
+
+func IsTimeout(err error) bool {
+    return errors.Is(err, ErrQueryTimeout)
+}
+
+// transient errors, the operation may succeed when retried:
+// serialization failures, deadlocks, timeouts and connection failures
+func IsRetryable(err error) bool {
+    if err == nil {
+        return false
+    }
+    if errors.Is(err, ErrQueryTimeout) || errors.Is(err, driver.ErrBadConn) {
+        return true
+    }
+    if code := ErrorCode(err); code != "" {
+        switch code {
+        case CodeSerializationFailure, CodeDeadlockDetected, CodeAdminShutdown, CodeCannotConnectNow, CodeTooManyConnections:
+            return true
+        }
+        // class 08: connection exception
+        return strings.HasPrefix(code, "08")
+    }
+    var netErr net.Error
+    return errors.As(err, &netErr)
+}
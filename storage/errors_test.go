@@ -0,0 +1,130 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+    "github.com/lib/pq"
+)
+
+func Test_MapContextErr(t *testing.T) {
+    canceled, cancel := context.WithCancel(context.Background())
+    cancel()
+    expired, cancel2 := context.WithTimeout(context.Background(), -time.Second)
+    defer cancel2()
+    timeout := &pq.Error{Code: CodeQueryCanceled, Message: "canceling statement due to statement timeout"}
+    userCancel := &pq.Error{Code: CodeQueryCanceled, Message: "canceling statement due to user request"}
+    other := errors.New("boom")
+
+    cases := []struct {
+        ctx context.Context
+        err error
+        kind error
+    }{
+        {canceled, other, ErrQueryCanceled},
+        {expired, other, ErrQueryTimeout},
+        {context.Background(), context.Canceled, ErrQueryCanceled},
+        {context.Background(), context.DeadlineExceeded, ErrQueryTimeout},
+        {context.Background(), timeout, ErrQueryTimeout},
+        {context.Background(), userCancel, ErrQueryCanceled},
+        {context.Background(), other, nil},
+    }
+    for i, item := range cases {
+        err := mapContextErr(item.ctx, item.err)
+        if item.kind == nil {
+            if err != item.err {
+                t.Errorf("case %d: should return the error as is, got %v", i, err)
+            }
+            continue
+        }
+        if !errors.Is(err, item.kind) {
+            t.Errorf("case %d: should be %v, got %v", i, item.kind, err)
+        }
+        // the driver error is kept
+        if !errors.Is(err, item.err) {
+            t.Errorf("case %d: should wrap %v, got %v", i, item.err, err)
+        }
+    }
+    // pq details stay reachable
+    if err := mapContextErr(context.Background(), userCancel); ErrorCode(err) != CodeQueryCanceled || IsTimeout(err) {
+        t.Errorf("user cancel should keep its code and not be a timeout: %v", err)
+    }
+    if err := mapContextErr(context.Background(), mapContextErr(context.Background(), timeout)); err.Error() != "err: query timeout: " + timeout.Error() {
+        t.Errorf("should not wrap twice: %v", err)
+    }
+}
+
+func Test_ContextVariants(t *testing.T) {
+    client, d := newFakeClient(t, 0, 0)
+    canceled, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err := client.QueryContext(canceled, "select 1"); !errors.Is(err, ErrQueryCanceled) || !errors.Is(err, context.Canceled) {
+        t.Errorf("query of a canceled context should be canceled: %v", err)
+    }
+    expired, cancel2 := context.WithTimeout(context.Background(), -time.Second)
+    defer cancel2()
+    if _, err := client.ExecContext(expired, "update t set a = 1"); !IsTimeout(err) {
+        t.Errorf("exec of an expired context should time out: %v", err)
+    }
+    // statement_timeout raised by the server
+    d.err = &pq.Error{Code: CodeQueryCanceled, Message: "canceling statement due to statement timeout"}
+    if _, err := client.QueryContext(context.Background(), "select 1"); !IsTimeout(err) || ErrorCode(err) != CodeQueryCanceled {
+        t.Errorf("statement timeout should time out: %v", err)
+    }
+    if _, err := client.ExecContext(context.Background(), "update t set a = 1"); !IsTimeout(err) {
+        t.Errorf("statement timeout should time out: %v", err)
+    }
+    d.err = nil
+    if _, err := client.QueryContext(context.Background(), "select 1"); err != nil {
+        t.Errorf("should query: %v", err)
+    }
+}
+
+func Test_ErrorClasses(t *testing.T) {
+    unique := &pq.Error{Code: CodeUniqueViolation, Constraint: "users_email_key"}
+    foreignKey := &pq.Error{Code: CodeForeignKeyViolation, Constraint: "orders_user_id_fkey"}
+    cases := []struct {
+        name string
+        err error
+        unique bool
+        foreignKey bool
+        invalid bool
+        retryable bool
+    }{
+        {"nil", nil, false, false, false, false},
+        {"unique", unique, true, false, false, false},
+        {"wrapped unique", fmt.Errorf("insert user: %w", unique), true, false, false, false},
+        {"foreign key", foreignKey, false, true, true, false},
+        {"not null", &pq.Error{Code: CodeNotNullViolation}, false, false, true, false},
+        {"check", &pq.Error{Code: CodeCheckViolation}, false, false, true, false},
+        {"serialization", &pq.Error{Code: CodeSerializationFailure}, false, false, false, true},
+        {"deadlock", &pq.Error{Code: CodeDeadlockDetected}, false, false, false, true},
+        {"shutdown", &pq.Error{Code: CodeAdminShutdown}, false, false, false, true},
+        {"too many connections", &pq.Error{Code: CodeTooManyConnections}, false, false, false, true},
+        {"connection failure", &pq.Error{Code: "08006"}, false, false, false, true},
+        {"syntax", &pq.Error{Code: "42601"}, false, false, false, false},
+        {"timeout", &queryError{ErrQueryTimeout, errors.New("slow")}, false, false, false, true},
+        {"canceled", &queryError{ErrQueryCanceled, errors.New("stop")}, false, false, false, false},
+        {"bad conn", driver.ErrBadConn, false, false, false, true},
+        {"net", &net.OpError{Op: "dial", Err: errors.New("refused")}, false, false, false, true},
+        {"other", errors.New("boom"), false, false, false, false},
+    }
+    for _, c := range cases {
+        if IsUniqueViolation(c.err) != c.unique || IsForeignKeyViolation(c.err) != c.foreignKey ||
+            IsInvalidInput(c.err) != c.invalid || IsRetryable(c.err) != c.retryable {
+            t.Errorf("%s: wrong class, unique %v, foreign key %v, invalid %v, retryable %v", c.name,
+                IsUniqueViolation(c.err), IsForeignKeyViolation(c.err), IsInvalidInput(c.err), IsRetryable(c.err))
+        }
+    }
+    if ConstraintName(unique) != "users_email_key" || ConstraintName(errors.New("boom")) != "" {
+        t.Error("wrong constraint name")
+    }
+    if !IsNotFound(sql.ErrNoRows) || !IsNotFound(fmt.Errorf("user: %w", ErrNotFound)) || IsNotFound(unique) {
+        t.Error("wrong not found")
+    }
+}
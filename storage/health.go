@@ -0,0 +1,98 @@
+package storage
+
+import (
+    "time"
+    "github.com/jackielihf/golib/log"
+)
+
+// connection health, maintained by the heartbeat
+
+const (
+    defaultHeartbeatInterval = 5 * time.Second
+    defaultMaxReconnectBackoff = time.Minute
+)
+
+type Health struct {
+    Available bool
+    LastError string
+    LastErrorAt time.Time
+    LastSuccess time.Time
+    ConsecutiveFailures int
+    Latency time.Duration  // of the last successful check
+}
+
+// available or not, by the last check
+func (that *PgClient) Available() bool {
+    that.mtx.RLock()
+    defer that.mtx.RUnlock()
+    return that.health.Available
+}
+
+func (that *PgClient) Health() Health {
+    that.mtx.RLock()
+    defer that.mtx.RUnlock()
+    return that.health
+}
+
+// subscribe up/down transitions. fn is called from the heartbeat goroutine, it should not block.
+func (that *PgClient) OnStateChange(fn func(available bool, health Health)) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    that.subscribers = append(that.subscribers, fn)
+}
+
+// record the result of a check, notify subscribers on transitions
+func (that *PgClient) recordCheck(err error, latency time.Duration) {
+    that.mtx.Lock()
+    prev := that.health.Available
+    now := time.Now()
+    if err == nil {
+        that.health.Available = true
+        that.health.LastSuccess = now
+        that.health.ConsecutiveFailures = 0
+        that.health.Latency = latency
+        // reset backoff
+        that.backoff = 0
+        that.nextReconnect = time.Time{}
+    }else{
+        that.health.Available = false
+        that.health.LastError = err.Error()
+        that.health.LastErrorAt = now
+        that.health.ConsecutiveFailures++
+    }
+    health := that.health
+    subscribers := that.subscribers
+    that.mtx.Unlock()
+
+    if prev == health.Available {
+        return
+    }
+    if health.Available {
+        log.Info("connected db: " + that.maskedConnStr)
+    }else if prev {
+        log.Warn("db unavailable: " + that.maskedConnStr)
+    }
+    for _, fn := range subscribers {
+        fn(health.Available, health)
+    }
+}
+
+// exponential backoff of reconnecting: interval, 2x, 4x ... up to MaxReconnectBackoff
+func (that *PgClient) shouldReconnect() bool {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    now := time.Now()
+    if now.Before(that.nextReconnect) {
+        return false
+    }
+    if that.backoff == 0 {
+        that.backoff = that.HeartbeatInterval
+    }else{
+        that.backoff *= 2
+    }
+    if that.backoff > that.MaxReconnectBackoff {
+        that.backoff = that.MaxReconnectBackoff
+    }
+    that.nextReconnect = now.Add(that.backoff)
+    return true
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func Test_HealthTransitions(t *testing.T) {
+
+    client := &PgClient{}
+    var events []bool
+    client.OnStateChange(func(available bool, health Health) {
+        events = append(events, available)
+    })
+
+    client.recordCheck(nil, time.Millisecond)
+    client.recordCheck(nil, time.Millisecond)
+    client.recordCheck(errors.New("connection refused"), 0)
+    client.recordCheck(errors.New("connection refused"), 0)
+    if len(events) != 2 || !events[0] || events[1] {
+        t.Errorf("should notify up then down once, got %v", events)
+    }
+    health := client.Health()
+    if client.Available() || health.ConsecutiveFailures != 2 || health.LastError != "connection refused" || health.Latency != time.Millisecond {
+        t.Errorf("wrong health: %+v", health)
+    }
+    client.recordCheck(nil, 2 * time.Millisecond)
+    if health = client.Health(); !health.Available || health.ConsecutiveFailures != 0 || len(events) != 3 {
+        t.Errorf("should recover: %+v", health)
+    }
+}
+
+func Test_ReconnectBackoff(t *testing.T) {
+
+    client := &PgClient{HeartbeatInterval: time.Second, MaxReconnectBackoff: 3 * time.Second}
+    if !client.shouldReconnect() || client.backoff != time.Second {
+        t.Error("first failure should reconnect at once")
+    }
+    if client.shouldReconnect() {
+        t.Error("should wait for the backoff")
+    }
+    for _, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+        client.nextReconnect = time.Now()
+        if !client.shouldReconnect() || client.backoff != expected {
+            t.Errorf("backoff should be %v, got %v", expected, client.backoff)
+        }
+    }
+    // reset on success
+    client.recordCheck(nil, 0)
+    if client.backoff != 0 || !client.shouldReconnect() {
+        t.Error("backoff should be reset after a successful check")
+    }
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+    "context"
+    "strings"
+    "time"
+    "github.com/jackielihf/golib"
+    "github.com/jackielihf/golib/log"
+)
+
+// query instrumentation hooks
+
+// placeholder of redacted argument values
+const RedactedArg = "<redacted>"
+
+type QueryEvent struct {
+    Op string        // query, query_row, insert, update, copy, insert_many
+    Sql string       // rewritten sql
+    Args []interface{}  // redacted unless PgClient.HookArgs
+    Start time.Time
+    Duration time.Duration  // set before AfterQuery
+    Rows int64       // affected rows, -1 when unknown (e.g. not scanned yet)
+    Err error
+}
+
+type QueryHook interface {
+    // may return a derived context, which is passed to AfterQuery and the query itself
+    BeforeQuery(ctx context.Context, event *QueryEvent) context.Context
+    AfterQuery(ctx context.Context, event *QueryEvent)
+}
+
+func (that *PgClient) AddHook(hook QueryHook) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    that.hooks = append(that.hooks, hook)
+}
+
+func (that *PgClient) getHooks() []QueryHook {
+    that.mtx.RLock()
+    defer that.mtx.RUnlock()
+    return that.hooks
+}
+
+// event is nil when there is no hook
+func (that *PgClient) beforeQuery(ctx context.Context, op string, sql string, args []interface{}) (context.Context, *QueryEvent) {
+    hooks := that.getHooks()
+    if len(hooks) == 0 {
+        return ctx, nil
+    }
+    if !that.HookArgs && len(args) > 0 {
+        redacted := make([]interface{}, len(args))
+        for i := range redacted {
+            redacted[i] = RedactedArg
+        }
+        args = redacted
+    }
+    event := &QueryEvent{Op: op, Sql: sql, Args: args, Start: time.Now(), Rows: -1}
+    for _, hook := range hooks {
+        ctx = hook.BeforeQuery(ctx, event)
+    }
+    return ctx, event
+}
+
+func (that *PgClient) afterQuery(ctx context.Context, event *QueryEvent, rows int64, err error) {
+    if event == nil {
+        return
+    }
+    event.Duration = time.Since(event.Start)
+    event.Err = err
+    if err == nil {
+        event.Rows = rows
+    }
+    for _, hook := range that.getHooks() {
+        hook.AfterQuery(ctx, event)
+    }
+}
+
+// log queries slower than Threshold through the log package
+type SlowQueryHook struct {
+    Threshold time.Duration
+}
+
+func NewSlowQueryHook(threshold time.Duration) *SlowQueryHook {
+    return &SlowQueryHook{threshold}
+}
+
+func (that *SlowQueryHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+    return ctx
+}
+
+func (that *SlowQueryHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+    if event.Duration < that.Threshold {
+        return
+    }
+    log.Warnf("slow query | %s | %v | rows: %d | err: %v | %s | args: %v", event.Op, event.Duration, event.Rows, event.Err, event.Sql, event.Args)
+}
+
+// send timers to statsd by golib.Statsd(), e.g. <prefix>.query, <prefix>.update
+// and count errors by <prefix>.<op>.error
+type StatsdHook struct {
+    Prefix string
+}
+
+func NewStatsdHook(prefix string) *StatsdHook {
+    return &StatsdHook{strings.TrimSuffix(prefix, ".")}
+}
+
+func (that *StatsdHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+    return ctx
+}
+
+func (that *StatsdHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+    client := golib.Statsd()
+    bucket := that.Prefix + "." + event.Op
+    client.Timing(bucket, event.Duration.Seconds() * 1000)
+    if event.Err != nil {
+        client.Increment(bucket + ".error")
+    }
+}
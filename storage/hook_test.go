@@ -0,0 +1,51 @@
+package storage
+
+import (
+    "context"
+    "testing"
+)
+
+type recordHook struct {
+    events []QueryEvent
+}
+
+func (h *recordHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+    return ctx
+}
+
+func (h *recordHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+    h.events = append(h.events, *event)
+}
+
+func Test_QueryHook(t *testing.T) {
+
+    client, _ := newFakeClient(t, 0, 0)
+    hook := new(recordHook)
+    client.AddHook(hook)
+
+    affected, err := client.Update("users", map[string]interface{}{"name": "jack"}, "id = ?", 1)
+    if err != nil || affected != 1 {
+        t.Fatal(err)
+    }
+    queryOne(t, client, "select n from numbers where id = ?")
+
+    if len(hook.events) != 2 {
+        t.Fatalf("should record 2 events, got %d", len(hook.events))
+    }
+    update := hook.events[0]
+    if update.Op != "update" || update.Sql != "UPDATE users SET name=$1 WHERE id = $2" || update.Rows != 1 {
+        t.Errorf("wrong update event: %+v", update)
+    }
+    if len(update.Args) != 2 || update.Args[0] != RedactedArg || update.Args[1] != RedactedArg {
+        t.Errorf("args should be redacted: %v", update.Args)
+    }
+    if query := hook.events[1]; query.Op != "query" || query.Sql != "select n from numbers where id = $1" || query.Rows != -1 {
+        t.Errorf("wrong query event: %+v", query)
+    }
+
+    client.HookArgs = true
+    client.Update("users", map[string]interface{}{"name": "jack"}, "id = ?", 1)
+    if args := hook.events[2].Args; args[0] != "jack" || args[1] != 1 {
+        t.Errorf("args should be passed when enabled: %v", args)
+    }
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "runtime/debug"
+    "sync"
+    "time"
+    "github.com/lib/pq"
+    "github.com/jackielihf/golib/log"
+    "github.com/jackielihf/golib/worker"
+)
+
+/*
+LISTEN/NOTIFY pub-sub
+
+usage:
+  client.Listen("cache_invalidate", func(n storage.Notification) {
+      var key CacheKey
+      if err := n.Decode(&key); err == nil { ... }
+  })
+  client.Notify("cache_invalidate", CacheKey{"users", 1})
+
+  // or hand notifications to a worker pool
+  client.Listen("jobs", storage.PoolHandler(pool))
+*/
+
+const defaultListenBufferSize = 1024
+
+var ErrListenerClosed = errors.New("err: listener closed")
+
+type Notification struct {
+    Channel string
+    Payload string
+    Pid int  // process id of the notifying backend
+}
+
+// decode a JSON payload
+func (that Notification) Decode(v interface{}) error {
+    return json.Unmarshal([]byte(that.Payload), v)
+}
+
+type NotificationHandler func(Notification)
+
+// hand notifications to a worker pool without blocking. the pool's handler receives a Notification.
+func PoolHandler(pool *worker.Pool) NotificationHandler {
+    return func(n Notification) {
+        if err := pool.ProcessNB(n); err != nil {
+            log.Warnf("notification dropped, channel: %s, err: %v", n.Channel, err)
+        }
+    }
+}
+
+type listener struct {
+    mtx sync.Mutex
+    client *PgClient
+    pqListener *pq.Listener
+    handlers map[string][]NotificationHandler
+    events chan Notification  // bounded
+    quit chan bool
+    closed bool
+}
+
+func (that *PgClient) getListener() *listener {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if that.listener != nil {
+        return that.listener
+    }
+    size := that.ListenBufferSize
+    if size < 1 {
+        size = defaultListenBufferSize
+    }
+    l := &listener{
+        client: that,
+        handlers: make(map[string][]NotificationHandler),
+        events: make(chan Notification, size),
+        quit: make(chan bool),
+    }
+    that.listener = l
+    // no need to follow the heartbeat: the pq listener reconnects, and listens on its channels again, by itself
+    go l.dispatch()
+    return l
+}
+
+// subscribe a channel. handlers run one by one on a single goroutine,
+// notifications are dropped when ListenBufferSize of them are pending.
+func (that *PgClient) Listen(channel string, handler NotificationHandler) error {
+    l := that.getListener()
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    if l.closed {
+        return ErrListenerClosed
+    }
+    if l.pqListener == nil {
+        l.open()
+    }
+    if _, ok := l.handlers[channel]; !ok {
+        if err := l.pqListener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+            return err
+        }
+    }
+    l.handlers[channel] = append(l.handlers[channel], handler)
+    return nil
+}
+
+// remove all handlers of a channel
+func (that *PgClient) Unlisten(channel string) error {
+    that.mtx.RLock()
+    l := that.listener
+    that.mtx.RUnlock()
+    if l == nil {
+        return nil
+    }
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    if _, ok := l.handlers[channel]; !ok {
+        return nil
+    }
+    delete(l.handlers, channel)
+    if l.pqListener == nil {
+        return nil
+    }
+    return l.pqListener.Unlisten(channel)
+}
+
+// send a notification. payload is sent as is when it is a string or []byte, otherwise encoded as JSON.
+func (that *PgClient) Notify(channel string, payload interface{}) error {
+    return that.NotifyContext(context.Background(), channel, payload)
+}
+
+func (that *PgClient) NotifyContext(ctx context.Context, channel string, payload interface{}) error {
+    var text string
+    switch v := payload.(type) {
+    case string:
+        text = v
+    case []byte:
+        text = string(v)
+    default:
+        bytes, err := json.Marshal(payload)
+        if err != nil {
+            return err
+        }
+        text = string(bytes)
+    }
+    stmt, done, err := that.prepare(ctx, "select pg_notify($1, $2)")
+    if err != nil {
+        return mapContextErr(ctx, err)
+    }
+    defer done()
+    _, err = stmt.ExecContext(ctx, channel, text)
+    return mapContextErr(ctx, err)
+}
+
+// open a pq listener, the lock must be held
+func (that *listener) open() {
+    maxBackoff := that.client.MaxReconnectBackoff
+    if maxBackoff < time.Second {
+        maxBackoff = defaultMaxReconnectBackoff
+    }
+    l := pq.NewListener(that.client.ConnStr, time.Second, maxBackoff, func(event pq.ListenerEventType, err error) {
+        if err != nil {
+            log.Warnf("listener: %v", err)
+        }
+    })
+    that.pqListener = l
+    go that.receive(l)
+}
+
+// move notifications into the bounded channel
+func (that *listener) receive(l *pq.Listener) {
+    for n := range l.Notify {
+        // nil after pq reconnected by itself
+        if n == nil {
+            log.Warnf("listener reconnected, notifications may have been missed")
+            continue
+        }
+        that.enqueue(Notification{n.Channel, n.Extra, n.BePid})
+    }
+}
+
+// queue a notification without blocking, false when dropped
+func (that *listener) enqueue(n Notification) bool {
+    select {
+    case that.events <- n:
+        return true
+    default:
+        log.Warnf("notification dropped, buffer full, channel: %s", n.Channel)
+        return false
+    }
+}
+
+func (that *listener) dispatch() {
+    for {
+        select {
+        case <-that.quit:
+            return
+        case n := <-that.events:
+            that.mtx.Lock()
+            handlers := that.handlers[n.Channel]
+            that.mtx.Unlock()
+            for _, handler := range handlers {
+                that.handle(handler, n)
+            }
+        }
+    }
+}
+
+// run a handler, a panic is logged and doesn't stop the dispatch
+func (that *listener) handle(handler NotificationHandler, n Notification) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Errorf("notification handler panic, channel: %s, err: %v\n%s", n.Channel, r, debug.Stack())
+        }
+    }()
+    handler(n)
+}
+
+func (that *listener) close() {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if that.closed {
+        return
+    }
+    that.closed = true
+    close(that.quit)
+    if that.pqListener != nil {
+        that.pqListener.Close()
+    }
+}
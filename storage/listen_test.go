@@ -0,0 +1,102 @@
+package storage
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+// a listener without a pq listener, notifications are queued by hand
+func newTestListener(size int) *listener {
+    return &listener{
+        handlers: make(map[string][]NotificationHandler),
+        events: make(chan Notification, size),
+        quit: make(chan bool),
+    }
+}
+
+func Test_ListenerBuffer(t *testing.T) {
+    l := newTestListener(2)
+    if !l.enqueue(Notification{Channel: "a", Payload: "1"}) || !l.enqueue(Notification{Channel: "a", Payload: "2"}) {
+        t.Fatal("should queue within the buffer")
+    }
+    if l.enqueue(Notification{Channel: "a", Payload: "3"}) {
+        t.Error("should drop when the buffer is full")
+    }
+    if n := <-l.events; n.Payload != "1" {
+        t.Errorf("should keep the order, got %s", n.Payload)
+    }
+    if !l.enqueue(Notification{Channel: "a", Payload: "4"}) {
+        t.Error("should queue again after a dispatch")
+    }
+}
+
+func Test_ListenerDispatch(t *testing.T) {
+    l := newTestListener(8)
+    var mtx sync.Mutex
+    var got []string
+    var wg sync.WaitGroup
+    record := func(name string) NotificationHandler {
+        return func(n Notification) {
+            mtx.Lock()
+            got = append(got, name + ":" + n.Payload)
+            mtx.Unlock()
+            wg.Done()
+        }
+    }
+    l.handlers["a"] = []NotificationHandler{
+        func(n Notification) { panic("faulty subscriber") },
+        record("h1"),
+        record("h2"),
+    }
+    l.handlers["b"] = []NotificationHandler{record("h3")}
+    go l.dispatch()
+    defer close(l.quit)
+
+    wg.Add(5)
+    l.enqueue(Notification{Channel: "a", Payload: "1"})
+    l.enqueue(Notification{Channel: "c", Payload: "x"})  // no handlers
+    l.enqueue(Notification{Channel: "b", Payload: "2"})
+    l.enqueue(Notification{Channel: "a", Payload: "3"})
+    done := make(chan bool)
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatalf("handlers should survive a panic, got %v", got)
+    }
+    mtx.Lock()
+    defer mtx.Unlock()
+    expected := []string{"h1:1", "h2:1", "h3:2", "h1:3", "h2:3"}
+    for i := range expected {
+        if got[i] != expected[i] {
+            t.Fatalf("should fan out in order, got %v", got)
+        }
+    }
+}
+
+func Test_Unlisten(t *testing.T) {
+    client := &PgClient{}
+    if err := client.Unlisten("a"); err != nil || client.listener != nil {
+        t.Fatalf("unlisten should not create a listener: %v", err)
+    }
+    l := newTestListener(8)
+    l.handlers["a"] = []NotificationHandler{func(n Notification) {}}
+    l.handlers["b"] = []NotificationHandler{func(n Notification) {}}
+    client.listener = l
+    if err := client.Unlisten("a"); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := l.handlers["a"]; ok {
+        t.Error("handlers of a should be removed")
+    }
+    if len(l.handlers["b"]) != 1 {
+        t.Error("handlers of b should be kept")
+    }
+    if err := client.Unlisten("a"); err != nil {
+        t.Errorf("unlisten twice should be a no-op: %v", err)
+    }
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "io/fs"
+    "path"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+    "github.com/jackielihf/golib/log"
+)
+
+/*
+schema migrations
+
+files are numbered up/down sql files in a directory or an embed.FS:
+  0001_create_users.up.sql
+  0001_create_users.down.sql
+  0002_add_email.up.sql
+
+usage:
+  migrator := storage.NewMigrator(client, os.DirFS("migrations"))
+  applied, err := migrator.Up(ctx, 0)
+*/
+
+const defaultMigrationTable = "schema_migrations"
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+var ErrNoDownMigration = errors.New("err: down migration not found")
+
+type Migration struct {
+    Version int64
+    Name string
+    Up string
+    Down string
+}
+
+type MigrationStatus struct {
+    Version int64
+    Name string
+    Applied bool
+    AppliedAt time.Time
+}
+
+type Migrator struct {
+    Client *PgClient
+    Source fs.FS   // os.DirFS(dir) or an embed.FS
+    Dir string     // directory within Source, default "."
+    Table string   // version table, default "schema_migrations"
+    DryRun bool    // log the sql instead of executing it
+}
+
+func NewMigrator(client *PgClient, source fs.FS) *Migrator {
+    return &Migrator{Client: client, Source: source, Dir: ".", Table: defaultMigrationTable}
+}
+
+func (that *Migrator) table() string {
+    if that.Table == "" {
+        return defaultMigrationTable
+    }
+    return that.Table
+}
+
+// advisory lock key, derived from the version table
+func (that *Migrator) lockKey() int64 {
+    h := fnv.New64a()
+    h.Write([]byte("golib.migrate." + that.table()))
+    return int64(h.Sum64())
+}
+
+// load migrations sorted by version
+func (that *Migrator) Load() ([]Migration, error) {
+    dir := that.Dir
+    if dir == "" {
+        dir = "."
+    }
+    entries, err := fs.ReadDir(that.Source, dir)
+    if err != nil {
+        return nil, err
+    }
+    byVersion := make(map[int64]*Migration)
+    for _, entry := range entries {
+        match := migrationFileRegexp.FindStringSubmatch(entry.Name())
+        if entry.IsDir() || match == nil {
+            continue
+        }
+        version, _ := strconv.ParseInt(match[1], 10, 64)
+        content, err2 := fs.ReadFile(that.Source, path.Join(dir, entry.Name()))
+        if err2 != nil {
+            return nil, err2
+        }
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = m
+        }else if m.Name != match[2] {
+            return nil, fmt.Errorf("duplicate migration version %d: %s, %s", version, m.Name, match[2])
+        }
+        if match[3] == "up" {
+            m.Up = string(content)
+        }else{
+            m.Down = string(content)
+        }
+    }
+    var list []Migration
+    for _, m := range byVersion {
+        if m.Up == "" {
+            return nil, fmt.Errorf("up migration not found: %d_%s", m.Version, m.Name)
+        }
+        list = append(list, *m)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+    return list, nil
+}
+
+// applied versions and times
+func (that *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+    result := make(map[int64]time.Time)
+    var exists bool
+    if err := conn.QueryRowContext(ctx, "select to_regclass($1) is not null", that.table()).Scan(&exists); err != nil {
+        return nil, err
+    }
+    if !exists {
+        return result, nil
+    }
+    rows, err := conn.QueryContext(ctx, fmt.Sprintf("select version, applied_at from %s", that.table()))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var version int64
+        var appliedAt time.Time
+        if err2 := rows.Scan(&version, &appliedAt); err2 != nil {
+            return nil, err2
+        }
+        result[version] = appliedAt
+    }
+    return result, rows.Err()
+}
+
+// run fn on a dedicated connection holding the advisory lock
+func (that *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+    conn, err := that.Client.Db.Conn(ctx)
+    if err != nil {
+        return mapContextErr(ctx, err)
+    }
+    defer conn.Close()
+    // wait for other runners
+    if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", that.lockKey()); err != nil {
+        return mapContextErr(ctx, err)
+    }
+    defer conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", that.lockKey())
+    if !that.DryRun {
+        createSql := fmt.Sprintf("create table if not exists %s (version bigint primary key, name text not null, applied_at timestamptz not null default now())", that.table())
+        if _, err := conn.ExecContext(ctx, createSql); err != nil {
+            return mapContextErr(ctx, err)
+        }
+    }
+    return fn(conn)
+}
+
+// status of every migration
+func (that *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+    migrations, err := that.Load()
+    if err != nil {
+        return nil, err
+    }
+    conn, err := that.Client.Db.Conn(ctx)
+    if err != nil {
+        return nil, mapContextErr(ctx, err)
+    }
+    defer conn.Close()
+    applied, err := that.applied(ctx, conn)
+    if err != nil {
+        return nil, mapContextErr(ctx, err)
+    }
+    list := make([]MigrationStatus, len(migrations))
+    for i, m := range migrations {
+        appliedAt, ok := applied[m.Version]
+        list[i] = MigrationStatus{m.Version, m.Name, ok, appliedAt}
+    }
+    return list, nil
+}
+
+// exec a migration and record the version in one transaction
+func (that *Migrator) exec(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+    script := m.Up
+    record := fmt.Sprintf("insert into %s (version, name) values ($1, $2)", that.table())
+    args := []interface{}{m.Version, m.Name}
+    direction := "up"
+    if !up {
+        script = m.Down
+        record = fmt.Sprintf("delete from %s where version = $1", that.table())
+        args = args[:1]
+        direction = "down"
+    }
+    if that.DryRun {
+        log.Infof("[dry run] migrate %s %d_%s:\n%s", direction, m.Version, m.Name, script)
+        return nil
+    }
+    log.Infof("migrate %s %d_%s", direction, m.Version, m.Name)
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, script); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("migrate %s %d_%s: %v", direction, m.Version, m.Name, err)
+    }
+    if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+// apply pending migrations in order. steps: max number to apply, 0 for all
+func (that *Migrator) Up(ctx context.Context, steps int) ([]Migration, error) {
+    migrations, err := that.Load()
+    if err != nil {
+        return nil, err
+    }
+    var done []Migration
+    err = that.locked(ctx, func(conn *sql.Conn) error {
+        applied, err := that.applied(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, m := range migrations {
+            if _, ok := applied[m.Version]; ok {
+                continue
+            }
+            if steps > 0 && len(done) >= steps {
+                break
+            }
+            if err := that.exec(ctx, conn, m, true); err != nil {
+                return err
+            }
+            done = append(done, m)
+        }
+        return nil
+    })
+    return done, mapContextErr(ctx, err)
+}
+
+// roll back applied migrations from the latest. steps: number to roll back, at least 1
+func (that *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+    migrations, err := that.Load()
+    if err != nil {
+        return nil, err
+    }
+    if steps < 1 {
+        steps = 1
+    }
+    var done []Migration
+    err = that.locked(ctx, func(conn *sql.Conn) error {
+        applied, err := that.applied(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+            m := migrations[i]
+            if _, ok := applied[m.Version]; !ok {
+                continue
+            }
+            if m.Down == "" {
+                return ErrNoDownMigration
+            }
+            if err := that.exec(ctx, conn, m, false); err != nil {
+                return err
+            }
+            done = append(done, m)
+        }
+        return nil
+    })
+    return done, mapContextErr(ctx, err)
+}
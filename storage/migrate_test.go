@@ -0,0 +1,113 @@
+package storage
+
+import (
+    "context"
+    "database/sql/driver"
+    "errors"
+    "strings"
+    "testing"
+    "testing/fstest"
+    "time"
+)
+
+func Test_MigratorLoad(t *testing.T) {
+
+    source := fstest.MapFS{
+        "migrations/0002_add_email.up.sql": {Data: []byte("alter table users add email text")},
+        "migrations/0001_create_users.up.sql": {Data: []byte("create table users (id serial primary key)")},
+        "migrations/0001_create_users.down.sql": {Data: []byte("drop table users")},
+        "migrations/README.md": {Data: []byte("ignored")},
+    }
+    migrator := NewMigrator(nil, source)
+    migrator.Dir = "migrations"
+    list, err := migrator.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(list) != 2 || list[0].Version != 1 || list[1].Version != 2 {
+        t.Fatalf("migrations should be sorted by version: %+v", list)
+    }
+    if list[0].Name != "create_users" || list[0].Down != "drop table users" || list[1].Down != "" {
+        t.Errorf("wrong migration loaded: %+v", list[0])
+    }
+
+    // down without up
+    source["migrations/0003_orphan.down.sql"] = &fstest.MapFile{Data: []byte("select 1")}
+    if _, err := migrator.Load(); err == nil {
+        t.Error("migration without up file should be rejected")
+    }
+}
+
+func Test_MigratorUpDown(t *testing.T) {
+
+    client, d := newFakeClient(t, 0, 0)
+    applied := []int64{1}
+    d.rows = func(query string) ([]string, [][]driver.Value) {
+        if strings.Contains(query, "to_regclass") {
+            return []string{"exists"}, [][]driver.Value{{true}}
+        }
+        var values [][]driver.Value
+        for _, version := range applied {
+            values = append(values, []driver.Value{version, time.Now()})
+        }
+        return []string{"version", "applied_at"}, values
+    }
+    source := fstest.MapFS{
+        "0001_a.up.sql": {Data: []byte("up 1")},
+        "0001_a.down.sql": {Data: []byte("down 1")},
+        "0002_b.up.sql": {Data: []byte("up 2")},
+        "0002_b.down.sql": {Data: []byte("down 2")},
+        "0003_c.up.sql": {Data: []byte("up 3")},
+        "0003_c.down.sql": {Data: []byte("down 3")},
+    }
+    migrator := NewMigrator(client, source)
+    ctx := context.Background()
+
+    // scripts of the executed statements, in order
+    scripts := func() string {
+        var list []string
+        for _, exec := range d.execs {
+            switch {
+            case strings.HasPrefix(exec, "up ") || strings.HasPrefix(exec, "down ") || exec == "commit" || exec == "rollback":
+                list = append(list, exec)
+            case strings.Contains(exec, "pg_advisory_lock"):
+                list = append(list, "lock")
+            case strings.Contains(exec, "pg_advisory_unlock"):
+                list = append(list, "unlock")
+            case strings.HasPrefix(exec, "insert into schema_migrations"):
+                list = append(list, "record")
+            case strings.HasPrefix(exec, "delete from schema_migrations"):
+                list = append(list, "unrecord")
+            }
+        }
+        d.execs = nil
+        return strings.Join(list, ",")
+    }
+
+    done, err := migrator.Up(ctx, 0)
+    if err != nil || len(done) != 2 || done[0].Version != 2 || done[1].Version != 3 {
+        t.Fatalf("should apply pending migrations in order: %+v %v", done, err)
+    }
+    if s := scripts(); s != "lock,up 2,record,commit,up 3,record,commit,unlock" {
+        t.Errorf("wrong up order: %s", s)
+    }
+
+    applied = []int64{1, 2, 3}
+    done, err = migrator.Down(ctx, 2)
+    if err != nil || len(done) != 2 || done[0].Version != 3 || done[1].Version != 2 {
+        t.Fatalf("should roll back from the latest: %+v %v", done, err)
+    }
+    if s := scripts(); s != "lock,down 3,unrecord,commit,down 2,unrecord,commit,unlock" {
+        t.Errorf("wrong down order: %s", s)
+    }
+
+    // a failed script rolls back, stops, and releases the lock
+    applied = []int64{1}
+    d.err, d.errTimes, d.errQuery = errors.New("syntax error"), 1, "up 2"
+    if done, err = migrator.Up(ctx, 1); err == nil || len(done) != 0 {
+        t.Errorf("failed migration should stop: %+v %v", done, err)
+    }
+    if s := scripts(); s != "lock,rollback,unlock" {
+        t.Errorf("wrong failure order: %s", s)
+    }
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+    "context"
     "database/sql"
     "fmt"
     _ "github.com/lib/pq"
@@ -8,6 +9,9 @@ import (
     "strings"
     "errors"
     "bytes"
+    "sort"
+    "sync"
+    "time"
     "github.com/jackielihf/golib/log"
 )
 
@@ -20,23 +24,59 @@ type PgClient struct {
     Dbname string
     Db *sql.DB
     ConnStr string
+    Config *PgConfig  // ssl, timeouts and pool sizing. built from the fields above when nil
+    CursorSecret string  // secret for signing page cursors, default: env pg_cursor_secret
+    StatementTimeout time.Duration  // server side statement_timeout of every query, 0: no limit
+    StmtCacheSize int  // capacity of the prepared statement cache, 0: default 256, <0: disabled
+    HeartbeatInterval time.Duration  // default 5s
+    MaxReconnectBackoff time.Duration  // default 1m
+    ListenBufferSize int  // max pending notifications, default 1024
+    HookArgs bool  // pass argument values to query hooks, redacted by default
+    NaturalTypes bool  // MapScan and CustomMapScan convert json, arrays, numeric and text into Go types
     sched *cron.Cron
-    available bool  // 是否可用
+    mtx sync.RWMutex
+    health Health  // 是否可用, guarded by mtx
+    subscribers []func(available bool, health Health)
+    backoff time.Duration
+    nextReconnect time.Time
+    listener *listener
+    hooks []QueryHook
+    stmts *stmtCache
+    maskedConnStr string  // for logging
 }
 
-// to do: sql cache
+// timeout of the heartbeat query
+const checkTimeout = 3 * time.Second
 
 func (that *PgClient) init() {
     that.formatConnStr()
-    that.available = false
+    that.health = Health{}
+    if that.HeartbeatInterval <= 0 {
+        that.HeartbeatInterval = defaultHeartbeatInterval
+    }
+    if that.MaxReconnectBackoff <= 0 {
+        that.MaxReconnectBackoff = defaultMaxReconnectBackoff
+    }
+    if that.StmtCacheSize == 0 {
+        that.StmtCacheSize = defaultStmtCacheSize
+    }
+    if that.StmtCacheSize > 0 {
+        that.stmts = newStmtCache(that.StmtCacheSize)
+    }
 }
 
 func (that *PgClient) formatConnStr() {
-    if that.Password != "" {
-        that.ConnStr = fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=disable", that.Host, that.Port, that.User, that.Password, that.Dbname)    
+    var config PgConfig
+    if that.Config != nil {
+        config = *that.Config
     }else{
-        that.ConnStr = fmt.Sprintf("host=%v port=%v user=%v dbname=%v sslmode=disable", that.Host, that.Port, that.User, that.Dbname)    
+        config = PgConfig{Host: that.Host, Port: that.Port, User: that.User, Password: that.Password, Dbname: that.Dbname}
+    }
+    if that.StatementTimeout > 0 {
+        config.StatementTimeout = that.StatementTimeout
     }
+    that.ConnStr = config.ConnStr()
+    that.maskedConnStr = config.MaskedConnStr()
 }
 // open a db connection
 func (that *PgClient) Open() {
@@ -49,28 +89,47 @@ func (that *PgClient) Open() {
 }
 
 func (that *PgClient) connect() {
-    log.Info("connecting db: " + that.ConnStr)
+    log.Info("connecting db: " + that.maskedConnStr)
     var err error
     if that.Db, err = sql.Open("postgres", that.ConnStr); err != nil {
         log.Errorf("%v", err)
+        return
+    }
+    // pool
+    if config := that.Config; config != nil {
+        if config.MaxOpenConns > 0 {
+            that.Db.SetMaxOpenConns(config.MaxOpenConns)
+        }
+        if config.MaxIdleConns > 0 {
+            that.Db.SetMaxIdleConns(config.MaxIdleConns)
+        }
+        if config.ConnMaxLifetime > 0 {
+            that.Db.SetConnMaxLifetime(config.ConnMaxLifetime)
+        }
     }
 }
 
 func (that *PgClient) check() error{
-    if err := that.Db.Ping(); err != nil {
-        that.available = false
+    ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+    defer cancel()
+    return that.checkContext(ctx)
+}
+
+func (that *PgClient) checkContext(ctx context.Context) error{
+    start := time.Now()
+    if err := that.Db.PingContext(ctx); err != nil {
+        err = mapContextErr(ctx, err)
+        that.recordCheck(err, 0)
         return err
     }
     // exec a simple query
-    if rows, err2 := that.Db.Query("select 1"); rows != nil && err2 == nil { // ok
-        if !that.available {
-            log.Info("connected db: " + that.ConnStr)
-            that.available = true
-        }
+    if rows, err2 := that.Db.QueryContext(ctx, "select 1"); rows != nil && err2 == nil { // ok
+        that.recordCheck(nil, time.Since(start))
         defer rows.Close()
         return nil    
     }else{
-        that.available = false
+        err2 = mapContextErr(ctx, err2)
+        that.recordCheck(err2, 0)
         return err2
     }
 }
@@ -78,11 +137,18 @@ func (that *PgClient) check() error{
 // check the connection available or not
 func (that *PgClient) heartbeating() {
     that.sched = cron.New()
-    that.sched.AddFunc("@every 5s", func(){
+    that.sched.AddFunc(fmt.Sprintf("@every %s", that.HeartbeatInterval), func(){
         if err := that.check(); err != nil {
             log.Warnf("%v", err)
+            if !that.shouldReconnect() {
+                return
+            }
             tempDb := that.Db
             that.connect()
+            // statements were prepared on the old db
+            if that.stmts != nil {
+                that.stmts.purge()
+            }
             tempDb.Close()        
         }
     })
@@ -91,6 +157,12 @@ func (that *PgClient) heartbeating() {
 
 func (that *PgClient) Close() {
     that.sched.Stop()
+    that.mtx.RLock()
+    l := that.listener
+    that.mtx.RUnlock()
+    if l != nil {
+        l.close()
+    }
     that.Db.Close()
 }
 
@@ -153,68 +225,116 @@ func (that *PgClient) Prepare(sql string) (*sql.Stmt, error){
 
 // query
 func (that *PgClient) Query(sql string, values ...interface{}) (*sql.Rows, error){
+    return that.QueryContext(context.Background(), sql, values...)
+}
+
+func (that *PgClient) QueryContext(ctx context.Context, sql string, values ...interface{}) (rows *sql.Rows, err error){
     sql = that.BuildSql(sql)
-    if stmt, err := that.Db.Prepare(sql); err == nil {
-        defer stmt.Close()  // close when this function returns
-        return stmt.Query(values...)
-    }else{
-        return nil, err
-    }
+    ctx, event := that.beforeQuery(ctx, "query", sql, values)
+    defer func(){ that.afterQuery(ctx, event, -1, err) }()
+    err = that.withStmt(ctx, sql, func(stmt *sqlStmt) (err2 error) {
+        rows, err2 = stmt.QueryContext(ctx, values...)
+        return err2
+    })
+    return rows, mapContextErr(ctx, err)
 }
 
 func (that *PgClient) QueryRow(sql string, values ...interface{}) (*sql.Row, error){
+    return that.QueryRowContext(context.Background(), sql, values...)
+}
+
+func (that *PgClient) QueryRowContext(ctx context.Context, sql string, values ...interface{}) (row *sql.Row, err error){
     sql = that.BuildSql(sql)
-    if stmt, err := that.Db.Prepare(sql); err == nil {
-        defer stmt.Close()  // close when this function returns
-        return stmt.QueryRow(values...), nil
-    }else{
-        return nil, err
+    ctx, event := that.beforeQuery(ctx, "query_row", sql, values)
+    defer func(){ that.afterQuery(ctx, event, -1, err) }()
+    err = that.withStmt(ctx, sql, func(stmt *sqlStmt) error {
+        row = stmt.QueryRowContext(ctx, values...)
+        // the query error, sql.ErrNoRows is left to Scan
+        if err2 := row.Err(); isStalePlan(err2) {
+            return err2
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, mapContextErr(ctx, err)
     }
+    return row, nil
 }
 
 // insert
 func (that *PgClient) Insert(table string, fields map[string]interface{}, returning string, src interface{}) (error){
-    var keys []string
-    var values []interface{}
-    for key, value := range fields {
+    return that.InsertContext(context.Background(), table, fields, returning, src)
+}
+
+// columns in sorted order and their values, so the same fields build the same sql, and hit the statement cache
+func sortedFields(fields map[string]interface{}) ([]string, []interface{}) {
+    keys := make([]string, 0, len(fields))
+    for key := range fields {
         keys = append(keys, key)
-        values = append(values, value)
     }
+    sort.Strings(keys)
+    values := make([]interface{}, len(keys))
+    for i, key := range keys {
+        values[i] = fields[key]
+    }
+    return keys, values
+}
+
+func (that *PgClient) InsertContext(ctx context.Context, table string, fields map[string]interface{}, returning string, src interface{}) (err error){
+    keys, values := sortedFields(fields)
     sql := that.BuildInsertSql(table, keys, returning)
-    if stmt, err := that.Db.Prepare(sql); err == nil {
-        defer stmt.Close()  // close when this function returns
-        row := stmt.QueryRow(values...)
+    ctx, event := that.beforeQuery(ctx, "insert", sql, values)
+    defer func(){ that.afterQuery(ctx, event, 1, err) }()
+    err = that.withStmt(ctx, sql, func(stmt *sqlStmt) error {
         if returning != "" && src != nil{
-            return row.Scan(src)
+            return stmt.QueryRowContext(ctx, values...).Scan(src)
         }
-        return nil
-    }else{
-        return err
-    }
+        _, err2 := stmt.ExecContext(ctx, values...)
+        return err2
+    })
+    return mapContextErr(ctx, err)
 }
 
 // update
 func (that *PgClient) Update(table string, fields map[string]interface{}, where string, vars ...interface{}) (int64, error){
-    var keys []string
-    var values []interface{}
-    for key, value := range fields {
-        keys = append(keys, key)
-        values = append(values, value)
-    }
+    return that.UpdateContext(context.Background(), table, fields, where, vars...)
+}
+
+func (that *PgClient) UpdateContext(ctx context.Context, table string, fields map[string]interface{}, where string, vars ...interface{}) (affected int64, err error){
+    keys, values := sortedFields(fields)
     for _, value := range vars {
         values = append(values, value)
     }
     sql := that.BuildUpdateSql(table, keys, where, "")
-    if stmt, err := that.Db.Prepare(sql); err == nil {
-        defer stmt.Close()  // close when this function returns
-        if res, err2 := stmt.Exec(values...); err2 != nil {
-            return 0, err2
-        }else{
-            return res.RowsAffected()
+    ctx, event := that.beforeQuery(ctx, "update", sql, values)
+    defer func(){ that.afterQuery(ctx, event, affected, err) }()
+    err = that.withStmt(ctx, sql, func(stmt *sqlStmt) error {
+        res, err2 := stmt.ExecContext(ctx, values...)
+        if err2 == nil {
+            affected, err2 = res.RowsAffected()
         }
-    }else{
-        return 0, err
-    }
+        return err2
+    })
+    return affected, mapContextErr(ctx, err)
+}
+
+// exec, returns the number of affected rows
+func (that *PgClient) Exec(sql string, values ...interface{}) (int64, error){
+    return that.ExecContext(context.Background(), sql, values...)
+}
+
+func (that *PgClient) ExecContext(ctx context.Context, sql string, values ...interface{}) (affected int64, err error){
+    sql = that.BuildSql(sql)
+    ctx, event := that.beforeQuery(ctx, "exec", sql, values)
+    defer func(){ that.afterQuery(ctx, event, affected, err) }()
+    err = that.withStmt(ctx, sql, func(stmt *sqlStmt) error {
+        res, err2 := stmt.ExecContext(ctx, values...)
+        if err2 == nil {
+            affected, err2 = res.RowsAffected()
+        }
+        return err2
+    })
+    return affected, mapContextErr(ctx, err)
 }
 
 type RowPage struct {
@@ -243,8 +363,9 @@ func (that *PgClient) SelectRowPage(sql string, page int, limit int, values ...i
     }
     // get page
     offset := (page - 1) * limit
-    pageSql := fmt.Sprintf("%s limit %d offset %d", sql, limit, offset)
-    if rows, err3 := that.Query(pageSql, values...); err3 == nil {
+    // bind parameters, so that every page shares one prepared statement
+    pageSql := sql + " limit ? offset ?"
+    if rows, err3 := that.Query(pageSql, append(append([]interface{}{}, values...), limit, offset)...); err3 == nil {
         resultPage.Rows = rows
         return &resultPage, nil
     }else{
@@ -253,14 +374,18 @@ func (that *PgClient) SelectRowPage(sql string, page int, limit int, values ...i
 }
 
 func (that *PgClient) SelectPage(sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
+    return that.SelectPageContext(context.Background(), sql, page, limit, doMapping, values...)
+}
+
+func (that *PgClient) SelectPageContext(ctx context.Context, sql string, page int64, limit int64, doMapping func()(interface{}, map[string]interface {}), values ...interface{}) (PageInfo, []interface{}, error){
     pageInfo := PageInfo{0, page, limit}
     // count
     countSql := fmt.Sprintf("select count(1) as total from (%s) _alias", sql)
-    if row, err := that.QueryRow(countSql, values...); err != nil {
+    if row, err := that.QueryRowContext(ctx, countSql, values...); err != nil {
         return pageInfo, nil, err
     }else{
         if err2 := row.Scan(&pageInfo.Total); err2 != nil {
-            return pageInfo, nil, err2
+            return pageInfo, nil, mapContextErr(ctx, err2)
         }
     }
     // no result
@@ -269,12 +394,14 @@ func (that *PgClient) SelectPage(sql string, page int64, limit int64, doMapping
     }
     // get page
     offset := (page - 1) * limit
-    pageSql := fmt.Sprintf("%s limit %d offset %d", sql, limit, offset)
-    if rows, err3 := that.Query(pageSql, values...); err3 != nil {
+    // bind parameters, so that every page shares one prepared statement
+    pageSql := sql + " limit ? offset ?"
+    if rows, err3 := that.QueryContext(ctx, pageSql, append(append([]interface{}{}, values...), limit, offset)...); err3 != nil {
         return pageInfo, nil, err3
     }else{
+        defer rows.Close()
         if result, err4 := that.ListScan(rows, doMapping); err4 != nil {
-            return pageInfo, nil, err4  
+            return pageInfo, nil, mapContextErr(ctx, err4)
         }else{
             return pageInfo, result, nil    
         }
@@ -283,14 +410,18 @@ func (that *PgClient) SelectPage(sql string, page int64, limit int64, doMapping
 
 // 查询一个结果，存放到src中
 func (that *PgClient) SelectOne(sql string, src FieldMapping, values ...interface{}) (int, error) {
-    if rows, err := that.Query(sql, values...); err == nil {
+    return that.SelectOneContext(context.Background(), sql, src, values...)
+}
+
+func (that *PgClient) SelectOneContext(ctx context.Context, sql string, src FieldMapping, values ...interface{}) (int, error) {
+    if rows, err := that.QueryContext(ctx, sql, values...); err == nil {
         defer rows.Close()
         // 扫描一次
         if rows.Next() {
             return 1, that.FieldScan(rows, src)    
         }
         // no available row
-        return 0, nil
+        return 0, mapContextErr(ctx, rows.Err())
     }else{
         return 0, err
     }
@@ -315,15 +446,19 @@ func (that *PgClient) MapScan(rows *sql.Rows) (FieldMapping, error){
     if err != nil {
         return nil, err
     }
-    pointers, _ := makePointers(len(cols))
+    pointers, values := makePointers(len(cols))
 
     if err2 := rows.Scan(pointers...); err2 != nil {
         return nil, err2
     }
+    if that.NaturalTypes {
+        if err3 := naturalValues(rows, values); err3 != nil {
+            return nil, err3
+        }
+    }
     ret := make(FieldMapping)
     for i, name := range cols {
-        v := pointers[i].(*interface{})
-        ret[name] = *v   
+        ret[name] = values[i]
     }
     return ret, nil
 }
@@ -334,16 +469,20 @@ func (that *PgClient) CustomMapScan(rows *sql.Rows, ret FieldMapping) error{
         return err
     }
     // make pointers
-    pointers, _ := makePointers(len(cols))
+    pointers, values := makePointers(len(cols))
 
     if err2 := rows.Scan(pointers...); err2 != nil {
         return err2
     }
+    if that.NaturalTypes {
+        if err3 := naturalValues(rows, values); err3 != nil {
+            return err3
+        }
+    }
     // pick fields
     for i, name := range cols {
         if _, ok := ret[name]; ok{
-            v := pointers[i].(*interface{})
-            ret[name] = *v   
+            ret[name] = values[i]
         }
     }
     return nil
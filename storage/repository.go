@@ -0,0 +1,390 @@
+package storage
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+generic repository configured by struct tags
+
+  type User struct {
+      _ struct{}            `table:"users"`
+      Id int64              `db:"id,pk"`
+      Name string           `db:"name"`
+      Version int64         `db:"version,version"`
+      CreatedAt time.Time   `db:"created_at,created"`
+      UpdatedAt time.Time   `db:"updated_at,updated"`
+      DeletedAt *time.Time  `db:"deleted_at,softdelete"`
+  }
+
+  users, err := storage.NewRepository[User](client)
+  user := &User{Name: "jack"}
+  err = users.Create(user)  // user.Id is filled by returning
+  user, err = users.Get(1)  // ErrNotFound when missing
+  info, list, err := users.List(storage.ListOptions{Where: "name like ?", Args: []interface{}{"j%"}}, 1, 20)
+
+options of db tags:
+  pk          primary key. omitted on insert when it is zero, then filled by returning
+  softdelete  Delete sets it to now, reads skip rows where it is not null
+  created     set to now on insert when it is zero
+  updated     set to now on insert and update
+  version     optimistic locking. Update requires the loaded version and increases it, or returns ErrVersionConflict
+fields without a db tag, or tagged `db:"-"`, are ignored. embedded structs are flattened.
+*/
+
+var ErrVersionConflict = errors.New("err: version conflict")
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type repoColumn struct {
+    name string
+    index []int
+    pk bool
+    softdelete bool
+    created bool
+    updated bool
+    version bool
+}
+
+type repoMeta struct {
+    table string
+    columns []*repoColumn
+    selectList string
+    pk *repoColumn
+    softdelete *repoColumn
+    version *repoColumn
+}
+
+// reflect.Type -> *repoMeta
+var repoMetas sync.Map
+
+func parseRepoMeta(t reflect.Type) (*repoMeta, error) {
+    if meta, ok := repoMetas.Load(t); ok {
+        return meta.(*repoMeta), nil
+    }
+    if t.Kind() != reflect.Struct {
+        return nil, fmt.Errorf("repository err: %s is not a struct", t)
+    }
+    meta := new(repoMeta)
+    if err := meta.parseFields(t, nil); err != nil {
+        return nil, err
+    }
+    if meta.table == "" {
+        return nil, fmt.Errorf("repository err: no table of %s, add a field `_ struct{} `table:\"name\"``", t)
+    }
+    if meta.pk == nil {
+        return nil, fmt.Errorf("repository err: no pk of %s", t)
+    }
+    names := make([]string, len(meta.columns))
+    for i, col := range meta.columns {
+        names[i] = col.name
+    }
+    meta.selectList = strings.Join(names, ",")
+    repoMetas.Store(t, meta)
+    return meta, nil
+}
+
+func (that *repoMeta) parseFields(t reflect.Type, parent []int) error {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        index := append(append([]int{}, parent...), i)
+        if field.Name == "_" {
+            if table := field.Tag.Get("table"); table != "" {
+                that.table = table
+            }
+            continue
+        }
+        tag, ok := field.Tag.Lookup("db")
+        if !ok && field.Anonymous && field.Type.Kind() == reflect.Struct {
+            if err := that.parseFields(field.Type, index); err != nil {
+                return err
+            }
+            continue
+        }
+        if !ok || tag == "-" || field.PkgPath != "" {
+            continue
+        }
+        parts := strings.Split(tag, ",")
+        col := &repoColumn{name: strings.TrimSpace(parts[0]), index: index}
+        if col.name == "" {
+            return fmt.Errorf("repository err: empty column name of field %s", field.Name)
+        }
+        for _, option := range parts[1:] {
+            switch strings.TrimSpace(option) {
+            case "pk":
+                col.pk = true
+                that.pk = col
+            case "softdelete":
+                col.softdelete = true
+                that.softdelete = col
+            case "created":
+                col.created = true
+            case "updated":
+                col.updated = true
+            case "version":
+                col.version = true
+                that.version = col
+            default:
+                return fmt.Errorf("repository err: unknown option %q of field %s", option, field.Name)
+            }
+        }
+        if (col.created || col.updated || col.softdelete) && !isTimeType(field.Type) {
+            return fmt.Errorf("repository err: field %s should be time.Time, *time.Time or sql.NullTime", field.Name)
+        }
+        if col.version {
+            switch field.Type.Kind() {
+            case reflect.Int, reflect.Int32, reflect.Int64:
+            default:
+                return fmt.Errorf("repository err: version field %s should be an integer", field.Name)
+            }
+        }
+        that.columns = append(that.columns, col)
+    }
+    return nil
+}
+
+func isTimeType(t reflect.Type) bool {
+    return t == timeType || t == reflect.PtrTo(timeType) || t == reflect.TypeOf(sql.NullTime{})
+}
+
+// set a time field to now
+func setNow(field reflect.Value, now time.Time) {
+    switch field.Type() {
+    case timeType:
+        field.Set(reflect.ValueOf(now))
+    case reflect.PtrTo(timeType):
+        field.Set(reflect.ValueOf(&now))
+    default:
+        field.Set(reflect.ValueOf(sql.NullTime{Time: now, Valid: true}))
+    }
+}
+
+type Repository[T any] struct {
+    Client *PgClient
+    meta *repoMeta
+}
+
+func NewRepository[T any](client *PgClient) (*Repository[T], error) {
+    meta, err := parseRepoMeta(reflect.TypeOf((*T)(nil)).Elem())
+    if err != nil {
+        return nil, err
+    }
+    return &Repository[T]{Client: client, meta: meta}, nil
+}
+
+func (that *Repository[T]) Table() string {
+    return that.meta.table
+}
+
+// column name -> field address
+func (that *Repository[T]) mapping(entity *T) FieldMapping {
+    v := reflect.ValueOf(entity).Elem()
+    ret := make(FieldMapping, len(that.meta.columns))
+    for _, col := range that.meta.columns {
+        ret[col.name] = v.FieldByIndex(col.index).Addr().Interface()
+    }
+    return ret
+}
+
+// add the soft delete condition
+func (that *Repository[T]) where(where string, withDeleted bool) string {
+    if that.meta.softdelete == nil || withDeleted {
+        return where
+    }
+    notDeleted := that.meta.softdelete.name + " is null"
+    if where == "" {
+        return notDeleted
+    }
+    return "(" + where + ") and " + notDeleted
+}
+
+// get by primary key, ErrNotFound when missing
+func (that *Repository[T]) Get(id interface{}) (*T, error) {
+    return that.GetContext(context.Background(), id)
+}
+
+func (that *Repository[T]) GetContext(ctx context.Context, id interface{}) (*T, error) {
+    entity := new(T)
+    sql := fmt.Sprintf("select %s from %s where %s", that.meta.selectList, that.meta.table, that.where(that.meta.pk.name + " = ?", false))
+    n, err := that.Client.SelectOneContext(ctx, sql, that.mapping(entity), id)
+    if err != nil {
+        return nil, err
+    }
+    if n == 0 {
+        return nil, ErrNotFound
+    }
+    return entity, nil
+}
+
+type ListOptions struct {
+    Where string           // with "?" placeholders, e.g. "name like ? and age > ?"
+    Args []interface{}
+    OrderBy string         // default: the primary key
+    WithDeleted bool       // include soft deleted rows
+}
+
+// a page of rows
+func (that *Repository[T]) List(opts ListOptions, page int64, limit int64) (PageInfo, []*T, error) {
+    return that.ListContext(context.Background(), opts, page, limit)
+}
+
+func (that *Repository[T]) ListContext(ctx context.Context, opts ListOptions, page int64, limit int64) (PageInfo, []*T, error) {
+    sql := fmt.Sprintf("select %s from %s", that.meta.selectList, that.meta.table)
+    if where := that.where(opts.Where, opts.WithDeleted); where != "" {
+        sql += " where " + where
+    }
+    orderBy := opts.OrderBy
+    if orderBy == "" {
+        orderBy = that.meta.pk.name
+    }
+    sql += " order by " + orderBy
+    doMapping := func() (interface{}, map[string]interface{}) {
+        entity := new(T)
+        return entity, that.mapping(entity)
+    }
+    pageInfo, items, err := that.Client.SelectPageContext(ctx, sql, page, limit, doMapping, opts.Args...)
+    list := make([]*T, len(items))
+    for i, item := range items {
+        list[i] = item.(*T)
+    }
+    return pageInfo, list, err
+}
+
+// insert. fills timestamps, the initial version, and the primary key when it is zero
+func (that *Repository[T]) Create(entity *T) error {
+    return that.CreateContext(context.Background(), entity)
+}
+
+func (that *Repository[T]) CreateContext(ctx context.Context, entity *T) error {
+    v := reflect.ValueOf(entity).Elem()
+    now := time.Now()
+    fields := make(map[string]interface{}, len(that.meta.columns))
+    var pkAddr interface{}
+    for _, col := range that.meta.columns {
+        field := v.FieldByIndex(col.index)
+        switch {
+        case col.pk && field.IsZero():
+            pkAddr = field.Addr().Interface()
+            continue
+        case col.created && field.IsZero(), col.updated:
+            setNow(field, now)
+        case col.version && field.IsZero():
+            field.SetInt(1)
+        }
+        fields[col.name] = field.Interface()
+    }
+    if pkAddr != nil {
+        return that.Client.InsertContext(ctx, that.meta.table, fields, that.meta.pk.name, pkAddr)
+    }
+    return that.Client.InsertContext(ctx, that.meta.table, fields, "", nil)
+}
+
+// update all columns by primary key.
+// with a version column, the row must still have the loaded version, ErrVersionConflict otherwise.
+func (that *Repository[T]) Update(entity *T) error {
+    return that.UpdateContext(context.Background(), entity)
+}
+
+func (that *Repository[T]) UpdateContext(ctx context.Context, entity *T) error {
+    v := reflect.ValueOf(entity).Elem()
+    now := time.Now()
+    fields := make(map[string]interface{}, len(that.meta.columns))
+    var updatedFields []reflect.Value
+    for _, col := range that.meta.columns {
+        if col.pk || col.created || col.softdelete || col.version {
+            continue
+        }
+        field := v.FieldByIndex(col.index)
+        if col.updated {
+            // set after a successful update
+            updatedFields = append(updatedFields, field)
+            fields[col.name] = now
+            continue
+        }
+        fields[col.name] = field.Interface()
+    }
+    id := v.FieldByIndex(that.meta.pk.index).Interface()
+    where := that.meta.pk.name + " = ?"
+    vars := []interface{}{id}
+    var version reflect.Value
+    if that.meta.version != nil {
+        version = v.FieldByIndex(that.meta.version.index)
+        fields[that.meta.version.name] = version.Int() + 1
+        where += " and " + that.meta.version.name + " = ?"
+        vars = append(vars, version.Int())
+    }
+    affected, err := that.Client.UpdateContext(ctx, that.meta.table, fields, that.where(where, false), vars...)
+    if err != nil {
+        return err
+    }
+    if affected == 0 {
+        if version.IsValid() {
+            if exists, err2 := that.ExistsContext(ctx, that.meta.pk.name + " = ?", id); err2 != nil {
+                return err2
+            }else if exists {
+                return ErrVersionConflict
+            }
+        }
+        return ErrNotFound
+    }
+    for _, field := range updatedFields {
+        setNow(field, now)
+    }
+    if version.IsValid() {
+        version.SetInt(version.Int() + 1)
+    }
+    return nil
+}
+
+// delete by primary key. soft deleted when there is a softdelete column. ErrNotFound when missing
+func (that *Repository[T]) Delete(id interface{}) error {
+    return that.DeleteContext(context.Background(), id)
+}
+
+func (that *Repository[T]) DeleteContext(ctx context.Context, id interface{}) error {
+    where := that.meta.pk.name + " = ?"
+    var affected int64
+    var err error
+    if that.meta.softdelete != nil {
+        fields := map[string]interface{}{that.meta.softdelete.name: time.Now()}
+        affected, err = that.Client.UpdateContext(ctx, that.meta.table, fields, that.where(where, false), id)
+    }else{
+        affected, err = that.Client.ExecContext(ctx, fmt.Sprintf("delete from %s where %s", that.meta.table, where), id)
+    }
+    if err != nil {
+        return err
+    }
+    if affected == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// whether a row matches, soft deleted rows are skipped
+func (that *Repository[T]) Exists(where string, args ...interface{}) (bool, error) {
+    return that.ExistsContext(context.Background(), where, args...)
+}
+
+func (that *Repository[T]) ExistsContext(ctx context.Context, where string, args ...interface{}) (bool, error) {
+    sql := "select 1 from " + that.meta.table
+    if where = that.where(where, false); where != "" {
+        sql += " where " + where
+    }
+    sql = fmt.Sprintf("select exists(%s) as n", sql)
+    var exists bool
+    row, err := that.Client.QueryRowContext(ctx, sql, args...)
+    if err != nil {
+        return false, err
+    }
+    if err = row.Scan(&exists); err != nil {
+        return false, mapContextErr(ctx, err)
+    }
+    return exists, nil
+}
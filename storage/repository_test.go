@@ -0,0 +1,88 @@
+package storage
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+type repoBase struct {
+    CreatedAt time.Time   `db:"created_at,created"`
+    UpdatedAt *time.Time  `db:"updated_at,updated"`
+}
+
+type repoUser struct {
+    _ struct{}            `table:"users"`
+    Id int64              `db:"id,pk"`
+    Name string           `db:"name"`
+    Version int64         `db:"version,version"`
+    DeletedAt *time.Time  `db:"deleted_at,softdelete"`
+    Ignored string
+    repoBase
+}
+
+func Test_RepositoryMeta(t *testing.T) {
+    users, err := NewRepository[repoUser](nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if users.Table() != "users" || users.meta.selectList != "id,name,version,deleted_at,created_at,updated_at" {
+        t.Errorf("wrong meta: %s %s", users.Table(), users.meta.selectList)
+    }
+    if users.meta.pk.name != "id" || users.meta.version.name != "version" || users.meta.softdelete.name != "deleted_at" {
+        t.Errorf("wrong special columns: %+v", users.meta)
+    }
+
+    type noTable struct {
+        Id int64 `db:"id,pk"`
+    }
+    if _, err := NewRepository[noTable](nil); err == nil {
+        t.Error("should fail without a table")
+    }
+    type badVersion struct {
+        _ struct{} `table:"t"`
+        Id int64 `db:"id,pk"`
+        Version string `db:"version,version"`
+    }
+    if _, err := NewRepository[badVersion](nil); err == nil {
+        t.Error("should fail with a string version")
+    }
+}
+
+func Test_RepositoryWrites(t *testing.T) {
+    client, _ := newFakeClient(t, 0, 0)
+    hook := new(recordHook)
+    client.AddHook(hook)
+    users, _ := NewRepository[repoUser](client)
+
+    // create: the fake driver returns 1 for returning id
+    user := &repoUser{Name: "jack"}
+    if err := users.Create(user); err != nil {
+        t.Fatal(err)
+    }
+    if user.Id != 1 || user.Version != 1 || user.CreatedAt.IsZero() || user.UpdatedAt == nil {
+        t.Errorf("fields should be filled: %+v", user)
+    }
+    if sql := hook.events[0].Sql; !strings.HasPrefix(sql, "INSERT INTO users") || !strings.HasSuffix(sql, "returning id") || strings.Contains(sql, "(id,") {
+        t.Errorf("wrong insert: %s", sql)
+    }
+
+    // update with version
+    if err := users.Update(user); err != nil {
+        t.Fatal(err)
+    }
+    if user.Version != 2 {
+        t.Errorf("version should be increased, got %d", user.Version)
+    }
+    if sql := hook.events[1].Sql; !strings.HasSuffix(sql, "WHERE (id = $4 and version = $5) and deleted_at is null") || strings.Contains(sql, "created_at") {
+        t.Errorf("wrong update: %s", sql)
+    }
+
+    // soft delete
+    if err := users.Delete(1); err != nil {
+        t.Fatal(err)
+    }
+    if sql := hook.events[2].Sql; sql != "UPDATE users SET deleted_at=$1 WHERE (id = $2) and deleted_at is null" {
+        t.Errorf("wrong delete: %s", sql)
+    }
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+    "github.com/robfig/cron"
+    "github.com/jackielihf/golib/log"
+)
+
+/*
+session store of issued tokens, keyed by the token id (jti).
+a token is active while its session exists, is not revoked and not expired.
+the web JWT middleware consults it, see web.JwtUseSessions.
+
+usage:
+  sessions := storage.NewPgSessionStore(client)
+  sessions.CreateTable(ctx)
+  sessions.StartCleanup()  // delete expired sessions periodically
+  web.JwtUseSessions(sessions)
+*/
+
+const defaultSessionTable = "sessions"
+const defaultSessionCleanup = "@every 10m"
+
+type PgSessionStore struct {
+    Client *PgClient
+    Table string        // default: sessions
+    CleanupSpec string  // cron spec of cleanup, default: @every 10m
+    sched *cron.Cron
+}
+
+func NewPgSessionStore(client *PgClient) *PgSessionStore {
+    return &PgSessionStore{Client: client, Table: defaultSessionTable, CleanupSpec: defaultSessionCleanup}
+}
+
+func (that *PgSessionStore) table() string {
+    if that.Table == "" {
+        return defaultSessionTable
+    }
+    return that.Table
+}
+
+// create the table if not exists
+func (that *PgSessionStore) CreateTable(ctx context.Context) error {
+    table := that.table()
+    sql := fmt.Sprintf(`create table if not exists %s (
+        jti varchar(64) primary key,
+        expires_at timestamptz not null,
+        revoked_at timestamptz,
+        created_at timestamptz not null default now()
+    )`, table)
+    if _, err := that.Client.Db.ExecContext(ctx, sql); err != nil {
+        return mapContextErr(ctx, err)
+    }
+    indexSql := fmt.Sprintf("create index if not exists %s_expires_at on %s (expires_at)", table, table)
+    _, err := that.Client.Db.ExecContext(ctx, indexSql)
+    return mapContextErr(ctx, err)
+}
+
+func (that *PgSessionStore) Create(ctx context.Context, jti string, expiresAt time.Time) error {
+    fields := map[string]interface{}{"jti": jti, "expires_at": expiresAt}
+    return that.Client.InsertContext(ctx, that.table(), fields, "", nil)
+}
+
+func (that *PgSessionStore) Active(ctx context.Context, jti string) (bool, error) {
+    sql := fmt.Sprintf("select exists(select 1 from %s where jti = ? and revoked_at is null and expires_at > now())", that.table())
+    row, err := that.Client.QueryRowContext(ctx, sql, jti)
+    if err != nil {
+        return false, err
+    }
+    var active bool
+    if err = row.Scan(&active); err != nil {
+        return false, mapContextErr(ctx, err)
+    }
+    return active, nil
+}
+
+// revoke a session, it is kept until it expires.
+// true when this call revoked an active session, by one conditional update, so of concurrent calls only one gets true
+func (that *PgSessionStore) Revoke(ctx context.Context, jti string) (bool, error) {
+    sql := fmt.Sprintf("update %s set revoked_at = now() where jti = ? and revoked_at is null and expires_at > now()", that.table())
+    affected, err := that.Client.ExecContext(ctx, sql, jti)
+    if err != nil {
+        return false, err
+    }
+    return affected > 0, nil
+}
+
+// delete expired sessions
+func (that *PgSessionStore) Cleanup(ctx context.Context) (int64, error) {
+    return that.Client.ExecContext(ctx, fmt.Sprintf("delete from %s where expires_at <= now()", that.table()))
+}
+
+// run Cleanup by the cron scheduler
+func (that *PgSessionStore) StartCleanup() {
+    spec := that.CleanupSpec
+    if spec == "" {
+        spec = defaultSessionCleanup
+    }
+    that.sched = cron.New()
+    that.sched.AddFunc(spec, func(){
+        if n, err := that.Cleanup(context.Background()); err != nil {
+            log.Warnf("session cleanup: %v", err)
+        }else if n > 0 {
+            log.Infof("session cleanup: %d expired", n)
+        }
+    })
+    that.sched.Start()
+}
+
+func (that *PgSessionStore) StopCleanup() {
+    if that.sched != nil {
+        that.sched.Stop()
+    }
+}
+
+// in-memory session store, for tests and single instance apps
+type MemorySessionStore struct {
+    mtx sync.Mutex
+    sessions map[string]*memorySession
+}
+
+type memorySession struct {
+    expiresAt time.Time
+    revoked bool
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+    return &MemorySessionStore{sessions: make(map[string]*memorySession)}
+}
+
+func (that *MemorySessionStore) Create(ctx context.Context, jti string, expiresAt time.Time) error {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if _, ok := that.sessions[jti]; ok {
+        return fmt.Errorf("session err: duplicate jti %s", jti)
+    }
+    that.sessions[jti] = &memorySession{expiresAt: expiresAt}
+    return nil
+}
+
+func (that *MemorySessionStore) Active(ctx context.Context, jti string) (bool, error) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    session, ok := that.sessions[jti]
+    return ok && !session.revoked && time.Now().Before(session.expiresAt), nil
+}
+
+func (that *MemorySessionStore) Revoke(ctx context.Context, jti string) (bool, error) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    session, ok := that.sessions[jti]
+    if !ok || session.revoked || !time.Now().Before(session.expiresAt) {
+        return false, nil
+    }
+    session.revoked = true
+    return true, nil
+}
+
+func (that *MemorySessionStore) Cleanup(ctx context.Context) (int64, error) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    now := time.Now()
+    var n int64
+    for jti, session := range that.sessions {
+        if !now.Before(session.expiresAt) {
+            delete(that.sessions, jti)
+            n++
+        }
+    }
+    return n, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func Test_MemorySessionStore(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemorySessionStore()
+    store.Create(ctx, "a", time.Now().Add(time.Hour))
+    store.Create(ctx, "b", time.Now().Add(-time.Second))
+    if err := store.Create(ctx, "a", time.Now().Add(time.Hour)); err == nil {
+        t.Error("duplicate jti should fail")
+    }
+
+    if active, _ := store.Active(ctx, "a"); !active {
+        t.Error("a should be active")
+    }
+    if active, _ := store.Active(ctx, "b"); active {
+        t.Error("expired b should not be active")
+    }
+    if active, _ := store.Active(ctx, "c"); active {
+        t.Error("unknown c should not be active")
+    }
+    if revoked, _ := store.Revoke(ctx, "a"); !revoked {
+        t.Error("should revoke active a")
+    }
+    if revoked, _ := store.Revoke(ctx, "a"); revoked {
+        t.Error("revoked a should not be revoked again")
+    }
+    if revoked, _ := store.Revoke(ctx, "b"); revoked {
+        t.Error("expired b should not be revoked")
+    }
+    if active, _ := store.Active(ctx, "a"); active {
+        t.Error("revoked a should not be active")
+    }
+    if n, _ := store.Cleanup(ctx); n != 1 {
+        t.Errorf("should clean up 1 expired session, got %d", n)
+    }
+}
+
+func Test_MemorySessionStoreRevokeOnce(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemorySessionStore()
+    store.Create(ctx, "a", time.Now().Add(time.Hour))
+    var revoked int64
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if ok, _ := store.Revoke(ctx, "a"); ok {
+                atomic.AddInt64(&revoked, 1)
+            }
+        }()
+    }
+    wg.Wait()
+    if revoked != 1 {
+        t.Errorf("only one concurrent revoke should succeed, got %d", revoked)
+    }
+}
+
+func Test_PgSessionStoreRevoke(t *testing.T) {
+    client, d := newFakeClient(t, 0, 0)
+    store := NewPgSessionStore(client)
+    var affected int64 = 1
+    d.affected = func(query string) int64 { return affected }
+
+    revoked, err := store.Revoke(context.Background(), "a")
+    if err != nil || !revoked {
+        t.Fatalf("should revoke: %v %v", revoked, err)
+    }
+    query := d.execs[len(d.execs) - 1]
+    if !strings.Contains(query, "update sessions set revoked_at = now() where jti = $1 and revoked_at is null and expires_at > now()") {
+        t.Errorf("revoke should be one conditional update: %s", query)
+    }
+    if len(d.args) != 1 || d.args[0] != "a" {
+        t.Errorf("wrong args: %v", d.args)
+    }
+    // revoked or expired before
+    affected = 0
+    if revoked, err = store.Revoke(context.Background(), "a"); err != nil || revoked {
+        t.Errorf("no row changed should not revoke: %v %v", revoked, err)
+    }
+}
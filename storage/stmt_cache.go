@@ -0,0 +1,187 @@
+package storage
+
+import (
+    "container/list"
+    "context"
+    "database/sql"
+    "strings"
+    "sync"
+    "github.com/jackielihf/golib/log"
+)
+
+// prepared statement cache
+// LRU of *sql.Stmt keyed by the rewritten sql.
+// statements in use are closed only after they are released.
+
+const defaultStmtCacheSize = 256
+
+type StmtCacheStats struct {
+    Hits int64
+    Misses int64
+    Size int
+    Capacity int
+}
+
+type cachedStmt struct {
+    sql string
+    db *sql.DB  // the db which prepared the statement
+    stmt *sql.Stmt
+    refs int
+    evicted bool
+}
+
+type stmtCache struct {
+    mtx sync.Mutex
+    capacity int
+    ll *list.List
+    items map[string]*list.Element
+    hits int64
+    misses int64
+}
+
+func newStmtCache(capacity int) *stmtCache {
+    return &stmtCache{
+        capacity: capacity,
+        ll: list.New(),
+        items: make(map[string]*list.Element),
+    }
+}
+
+// get a prepared statement, prepare it on miss. call release when done.
+func (that *stmtCache) get(ctx context.Context, db *sql.DB, query string) (*cachedStmt, error) {
+    that.mtx.Lock()
+    if elem, ok := that.items[query]; ok {
+        cs := elem.Value.(*cachedStmt)
+        if cs.db == db {
+            that.hits++
+            cs.refs++
+            that.ll.MoveToFront(elem)
+            that.mtx.Unlock()
+            return cs, nil
+        }
+        // prepared on a db replaced by reconnecting
+        that.remove(elem)
+    }
+    that.misses++
+    that.mtx.Unlock()
+
+    // prepare without holding the lock
+    stmt, err := db.PrepareContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    cs := &cachedStmt{sql: query, db: db, stmt: stmt, refs: 1}
+
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if elem, ok := that.items[query]; ok {
+        if elem.Value.(*cachedStmt).db == db {
+            // prepared by another goroutine meanwhile, keep ours out of the cache
+            cs.evicted = true
+            return cs, nil
+        }
+        that.remove(elem)
+    }
+    that.items[query] = that.ll.PushFront(cs)
+    for that.ll.Len() > that.capacity {
+        that.remove(that.ll.Back())
+    }
+    return cs, nil
+}
+
+func (that *stmtCache) release(cs *cachedStmt) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    cs.refs--
+    if cs.evicted && cs.refs <= 0 {
+        cs.stmt.Close()
+    }
+}
+
+// remove an element. the lock must be held
+func (that *stmtCache) remove(elem *list.Element) {
+    cs := elem.Value.(*cachedStmt)
+    that.ll.Remove(elem)
+    delete(that.items, cs.sql)
+    cs.evicted = true
+    if cs.refs <= 0 {
+        cs.stmt.Close()
+    }
+}
+
+// drop the statement of a query
+func (that *stmtCache) invalidate(query string) {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if elem, ok := that.items[query]; ok {
+        that.remove(elem)
+    }
+}
+
+// drop all statements, e.g. after reconnecting
+func (that *stmtCache) purge() {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    for elem := that.ll.Front(); elem != nil; elem = that.ll.Front() {
+        that.remove(elem)
+    }
+}
+
+func (that *stmtCache) stats() StmtCacheStats {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    return StmtCacheStats{that.hits, that.misses, that.ll.Len(), that.capacity}
+}
+
+// prepare a statement through the cache. done must be called when the statement is no longer used.
+func (that *PgClient) prepare(ctx context.Context, query string) (*sql.Stmt, func(), error) {
+    if that.stmts == nil {
+        stmt, err := that.Db.PrepareContext(ctx, query)
+        if err != nil {
+            return nil, nil, err
+        }
+        return stmt, func(){ stmt.Close() }, nil
+    }
+    cs, err := that.stmts.get(ctx, that.Db, query)
+    if err != nil {
+        return nil, nil, err
+    }
+    return cs.stmt, func(){ that.stmts.release(cs) }, nil
+}
+
+// 0A000 "cached plan must not change result type": the result columns of a prepared statement
+// changed since it was prepared, e.g. select * after a migration added a column
+func isStalePlan(err error) bool {
+    pqErr := asPqError(err)
+    return pqErr != nil && pqErr.Code == CodeFeatureNotSupported && strings.Contains(pqErr.Message, "cached plan must not change result type")
+}
+
+// *sql.Stmt, for functions whose sql parameter shadows the package
+type sqlStmt = sql.Stmt
+
+// run fn with a prepared statement of the query. a statement with a stale plan is dropped,
+// and fn runs once more with a freshly prepared one
+func (that *PgClient) withStmt(ctx context.Context, query string, fn func(stmt *sql.Stmt) error) error {
+    for retry := true; ; retry = false {
+        stmt, done, err := that.prepare(ctx, query)
+        if err != nil {
+            return err
+        }
+        err = fn(stmt)
+        done()
+        if retry && that.stmts != nil && isStalePlan(err) {
+            log.Warnf("stmt cache: stale plan, prepare again: %s", query)
+            that.stmts.invalidate(query)
+            continue
+        }
+        return err
+    }
+}
+
+// hit/miss stats of the statement cache
+func (that *PgClient) StmtCacheStats() StmtCacheStats {
+    if that.stmts == nil {
+        return StmtCacheStats{}
+    }
+    return that.stmts.stats()
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/lib/pq"
+)
+
+// a fake driver counting prepared statements
+type fakeDriver struct {
+    prepares int64
+    closes int64
+    latency time.Duration  // simulated round trip of prepare
+    err error  // returned by queries and execs when set
+    errTimes int64  // err is returned this many times, 0: always
+    errQuery string  // err is returned for statements containing it, "": all
+    args []driver.Value  // of the last query or exec
+    execs []string  // executed statements, and commit / rollback
+    rows func(query string) ([]string, [][]driver.Value)  // rows of a query, default: one row n = 1
+    affected func(query string) int64  // rows affected by an exec, default: 1
+}
+
+// the error of a query or exec, and record its args
+func (d *fakeDriver) result(query string, args []driver.Value) error {
+    d.args = args
+    if d.err == nil || !strings.Contains(query, d.errQuery) {
+        return nil
+    }
+    err := d.err
+    if d.errTimes > 0 {
+        if d.errTimes--; d.errTimes == 0 {
+            d.err = nil
+        }
+    }
+    return err
+}
+
+type fakeConn struct {
+    driver *fakeDriver
+}
+
+type fakeStmt struct {
+    driver *fakeDriver
+    query string
+}
+
+type fakeTx struct {
+    driver *fakeDriver
+}
+
+type fakeRows struct {
+    cols []string
+    values [][]driver.Value
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+    return &fakeConn{d}, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+    atomic.AddInt64(&c.driver.prepares, 1)
+    if c.driver.latency > 0 {
+        time.Sleep(c.driver.latency)
+    }
+    return &fakeStmt{c.driver, query}, nil
+}
+func (c *fakeConn) Close() error {
+    return nil
+}
+func (c *fakeConn) Begin() (driver.Tx, error) {
+    return &fakeTx{c.driver}, nil
+}
+
+func (tx *fakeTx) Commit() error {
+    tx.driver.execs = append(tx.driver.execs, "commit")
+    return nil
+}
+func (tx *fakeTx) Rollback() error {
+    tx.driver.execs = append(tx.driver.execs, "rollback")
+    return nil
+}
+
+func (s *fakeStmt) Close() error {
+    atomic.AddInt64(&s.driver.closes, 1)
+    return nil
+}
+func (s *fakeStmt) NumInput() int {
+    return -1
+}
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+    if err := s.driver.result(s.query, args); err != nil {
+        return nil, err
+    }
+    s.driver.execs = append(s.driver.execs, s.query)
+    if s.driver.affected != nil {
+        return driver.RowsAffected(s.driver.affected(s.query)), nil
+    }
+    return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+    if err := s.driver.result(s.query, args); err != nil {
+        return nil, err
+    }
+    if s.driver.rows != nil {
+        cols, values := s.driver.rows(s.query)
+        return &fakeRows{cols, values}, nil
+    }
+    return &fakeRows{[]string{"n"}, [][]driver.Value{{int64(1)}}}, nil
+}
+
+func (r *fakeRows) Columns() []string {
+    return r.cols
+}
+func (r *fakeRows) Close() error {
+    return nil
+}
+func (r *fakeRows) Next(dest []driver.Value) error {
+    if len(r.values) == 0 {
+        return io.EOF
+    }
+    copy(dest, r.values[0])
+    r.values = r.values[1:]
+    return nil
+}
+
+var fakeDrivers int64
+
+// new a client on a fake driver, without heartbeat
+func newFakeClient(t testing.TB, cacheSize int, latency time.Duration) (*PgClient, *fakeDriver) {
+    d := &fakeDriver{latency: latency}
+    name := fmt.Sprintf("fake%d", atomic.AddInt64(&fakeDrivers, 1))
+    sql.Register(name, d)
+    db, err := sql.Open(name, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := &PgClient{Db: db, StmtCacheSize: cacheSize}
+    client.init()
+    return client, d
+}
+
+func queryOne(t testing.TB, client *PgClient, query string) {
+    rows, err := client.Query(query)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for rows.Next() {
+    }
+    rows.Close()
+}
+
+func Test_StmtCache(t *testing.T) {
+
+    client, d := newFakeClient(t, 2, 0)
+    for i := 0; i < 10; i++ {
+        queryOne(t, client, "select ?")
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 1 {
+        t.Errorf("statement should be prepared once, got %d", n)
+    }
+    stats := client.StmtCacheStats()
+    if stats.Hits != 9 || stats.Misses != 1 || stats.Size != 1 {
+        t.Errorf("wrong stats: %+v", stats)
+    }
+
+    // evict the least recently used
+    queryOne(t, client, "select 2")
+    queryOne(t, client, "select ?")
+    queryOne(t, client, "select 3")
+    if stats = client.StmtCacheStats(); stats.Size != 2 {
+        t.Errorf("cache should be bounded, got %+v", stats)
+    }
+    if n := atomic.LoadInt64(&d.closes); n != 1 {
+        t.Errorf("evicted statement should be closed, got %d", n)
+    }
+    queryOne(t, client, "select ?")
+    if n := atomic.LoadInt64(&d.prepares); n != 3 {
+        t.Errorf("recently used statement should stay cached, got %d prepares", n)
+    }
+
+    // purge on reconnect
+    client.stmts.purge()
+    if n := atomic.LoadInt64(&d.closes); n != 3 {
+        t.Errorf("purged statements should be closed, got %d", n)
+    }
+    queryOne(t, client, "select ?")
+    if n := atomic.LoadInt64(&d.prepares); n != 4 {
+        t.Errorf("statement should be prepared again after purge, got %d", n)
+    }
+}
+
+func Test_StmtCacheDisabled(t *testing.T) {
+
+    client, d := newFakeClient(t, -1, 0)
+    for i := 0; i < 3; i++ {
+        queryOne(t, client, "select ?")
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 3 {
+        t.Errorf("every query should prepare when disabled, got %d", n)
+    }
+    if n := atomic.LoadInt64(&d.closes); n != 3 {
+        t.Errorf("every statement should be closed when disabled, got %d", n)
+    }
+}
+
+func Test_StmtCacheStalePlan(t *testing.T) {
+
+    client, d := newFakeClient(t, 0, 0)
+    queryOne(t, client, "select * from t")
+    // a migration changed the columns of t
+    d.err = &pq.Error{Code: CodeFeatureNotSupported, Message: "cached plan must not change result type"}
+    d.errTimes = 1
+    queryOne(t, client, "select * from t")
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("stale statement should be prepared again, got %d prepares", n)
+    }
+    d.err, d.errTimes = &pq.Error{Code: CodeFeatureNotSupported, Message: "cached plan must not change result type"}, 1
+    if _, err := client.Exec("update t set a = 1"); err != nil {
+        t.Errorf("exec should retry a stale plan: %v", err)
+    }
+    d.err, d.errTimes = &pq.Error{Code: CodeFeatureNotSupported, Message: "cached plan must not change result type"}, 1
+    row, err := client.QueryRow("select * from t")
+    var n int64
+    if err != nil || row.Scan(&n) != nil || n != 1 {
+        t.Errorf("query row should retry a stale plan: %v", err)
+    }
+    // other errors are returned, once
+    d.err, d.errTimes = &pq.Error{Code: CodeUniqueViolation}, 2
+    if _, err := client.Exec("insert into t values (1)"); !IsUniqueViolation(err) {
+        t.Errorf("should return the error: %v", err)
+    }
+}
+
+func Test_PageSqlShared(t *testing.T) {
+
+    client, d := newFakeClient(t, 0, 0)
+    mapping := func() (interface{}, map[string]interface{}) {
+        n := new(int64)
+        return n, map[string]interface{}{"n": n}
+    }
+    for page := int64(1); page <= 5; page++ {
+        if _, _, err := client.SelectPage("select * from t where a = ?", page, 20, mapping, "x"); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if fmt.Sprint(d.args) != "[x 20 80]" {
+        t.Errorf("limit and offset should be bound, got %v", d.args)
+    }
+    // the count statement and the page statement
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("pages should share statements, got %d prepares", n)
+    }
+}
+
+func Test_FieldsSqlShared(t *testing.T) {
+
+    client, d := newFakeClient(t, 0, 0)
+    fields := make(map[string]interface{})
+    for i := 0; i < 12; i++ {
+        fields[fmt.Sprintf("c%02d", i)] = i
+    }
+    for i := 0; i < 50; i++ {
+        if err := client.Insert("t", fields, "", nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 1 {
+        t.Errorf("inserts of the same fields should share a statement, got %d prepares", n)
+    }
+    // values follow the sorted columns
+    if !strings.HasPrefix(d.execs[len(d.execs) - 1], "INSERT INTO t (c00,c01,c02") || fmt.Sprint(d.args[:3]) != "[0 1 2]" {
+        t.Errorf("wrong insert: %s %v", d.execs[len(d.execs) - 1], d.args)
+    }
+    for i := 0; i < 50; i++ {
+        if _, err := client.Update("t", fields, "id = ?", 7); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := atomic.LoadInt64(&d.prepares); n != 2 {
+        t.Errorf("updates of the same fields should share a statement, got %d prepares", n)
+    }
+    if fmt.Sprint(d.args) != "[0 1 2 3 4 5 6 7 8 9 10 11 7]" {
+        t.Errorf("wrong update args: %v", d.args)
+    }
+}
+
+// benchmark against postgres when env pg_host or pg_url is set, otherwise against
+// the fake driver with a simulated round trip for prepare.
+func benchClient(b *testing.B, cacheSize int) *PgClient {
+    if os.Getenv("pg_host") == "" && os.Getenv("pg_url") == "" {
+        client, _ := newFakeClient(b, cacheSize, 100 * time.Microsecond)
+        return client
+    }
+    config, err := PgConfigFromEnv()
+    if err != nil {
+        b.Fatal(err)
+    }
+    client := NewPgClient(config)
+    client.StmtCacheSize = cacheSize
+    client.init()
+    client.connect()
+    if err := client.check(); err != nil {
+        b.Skip(err)
+    }
+    return client
+}
+
+func benchmarkQuery(b *testing.B, cacheSize int) {
+    client := benchClient(b, cacheSize)
+    defer client.Db.Close()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        queryOne(b, client, "select 1")
+    }
+}
+
+func Benchmark_QueryWithoutStmtCache(b *testing.B) {
+    benchmarkQuery(b, -1)
+}
+
+func Benchmark_QueryWithStmtCache(b *testing.B) {
+    benchmarkQuery(b, 0)
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "github.com/lib/pq"
+)
+
+// typed column helpers. they scan from and write to postgresql columns,
+// and serialize to plain JSON, NULL as null.
+
+// jsonb/json column decoded into T
+type JSONB[T any] struct {
+    Data T
+    Valid bool  // false: NULL
+}
+
+func NewJSONB[T any](data T) JSONB[T] {
+    return JSONB[T]{data, true}
+}
+
+func (that *JSONB[T]) Scan(src interface{}) error {
+    var zero T
+    that.Data, that.Valid = zero, false
+    var bytes []byte
+    switch v := src.(type) {
+    case nil:
+        return nil
+    case []byte:
+        bytes = v
+    case string:
+        bytes = []byte(v)
+    default:
+        return fmt.Errorf("JSONB scan err: unsupported type %T", src)
+    }
+    if err := json.Unmarshal(bytes, &that.Data); err != nil {
+        return err
+    }
+    that.Valid = true
+    return nil
+}
+
+func (that JSONB[T]) Value() (driver.Value, error) {
+    if !that.Valid {
+        return nil, nil
+    }
+    return json.Marshal(that.Data)
+}
+
+func (that JSONB[T]) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.Data)
+}
+
+func (that *JSONB[T]) UnmarshalJSON(data []byte) error {
+    if string(data) == "null" {
+        var zero T
+        that.Data, that.Valid = zero, false
+        return nil
+    }
+    that.Valid = true
+    return json.Unmarshal(data, &that.Data)
+}
+
+// text[], varchar[] column. nil: NULL
+type StringArray []string
+
+func (that *StringArray) Scan(src interface{}) error {
+    return (*pq.StringArray)(that).Scan(src)
+}
+
+func (that StringArray) Value() (driver.Value, error) {
+    return pq.StringArray(that).Value()
+}
+
+// int2[], int4[], int8[] column. nil: NULL
+type Int64Array []int64
+
+func (that *Int64Array) Scan(src interface{}) error {
+    return (*pq.Int64Array)(that).Scan(src)
+}
+
+func (that Int64Array) Value() (driver.Value, error) {
+    return pq.Int64Array(that).Value()
+}
+
+// float4[], float8[] column. nil: NULL
+type Float64Array []float64
+
+func (that *Float64Array) Scan(src interface{}) error {
+    return (*pq.Float64Array)(that).Scan(src)
+}
+
+func (that Float64Array) Value() (driver.Value, error) {
+    return pq.Float64Array(that).Value()
+}
+
+// nullable columns, marshaled as the value or null
+type NullTime struct {
+    sql.NullTime
+}
+
+func (that NullTime) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.Time)
+}
+
+func (that *NullTime) UnmarshalJSON(data []byte) error {
+    that.Valid = string(data) != "null"
+    if !that.Valid {
+        return nil
+    }
+    return json.Unmarshal(data, &that.Time)
+}
+
+type NullString struct {
+    sql.NullString
+}
+
+func (that NullString) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.String)
+}
+
+func (that *NullString) UnmarshalJSON(data []byte) error {
+    that.Valid = string(data) != "null"
+    if !that.Valid {
+        return nil
+    }
+    return json.Unmarshal(data, &that.String)
+}
+
+type NullInt64 struct {
+    sql.NullInt64
+}
+
+func (that NullInt64) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.Int64)
+}
+
+func (that *NullInt64) UnmarshalJSON(data []byte) error {
+    that.Valid = string(data) != "null"
+    if !that.Valid {
+        return nil
+    }
+    return json.Unmarshal(data, &that.Int64)
+}
+
+type NullFloat64 struct {
+    sql.NullFloat64
+}
+
+func (that NullFloat64) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.Float64)
+}
+
+func (that *NullFloat64) UnmarshalJSON(data []byte) error {
+    that.Valid = string(data) != "null"
+    if !that.Valid {
+        return nil
+    }
+    return json.Unmarshal(data, &that.Float64)
+}
+
+type NullBool struct {
+    sql.NullBool
+}
+
+func (that NullBool) MarshalJSON() ([]byte, error) {
+    if !that.Valid {
+        return []byte("null"), nil
+    }
+    return json.Marshal(that.Bool)
+}
+
+func (that *NullBool) UnmarshalJSON(data []byte) error {
+    that.Valid = string(data) != "null"
+    if !that.Valid {
+        return nil
+    }
+    return json.Unmarshal(data, &that.Bool)
+}
+
+// convert a raw value of MapScan by the database type name:
+// json/jsonb decoded, arrays into slices, numeric and text-like bytes into strings.
+// timestamps come as time.Time from the driver already.
+func naturalValue(typeName string, v interface{}) (interface{}, error) {
+    bytes, ok := v.([]byte)
+    if !ok {
+        return v, nil
+    }
+    typeName = strings.ToUpper(typeName)
+    switch typeName {
+    case "JSON", "JSONB":
+        var ret interface{}
+        if err := json.Unmarshal(bytes, &ret); err != nil {
+            return nil, err
+        }
+        return ret, nil
+    case "BYTEA":
+        return bytes, nil
+    case "_TEXT", "_VARCHAR", "_BPCHAR", "_UUID", "_NUMERIC":
+        var ret pq.StringArray
+        err := ret.Scan(bytes)
+        return []string(ret), err
+    case "_INT2", "_INT4", "_INT8":
+        var ret pq.Int64Array
+        err := ret.Scan(bytes)
+        return []int64(ret), err
+    case "_FLOAT4", "_FLOAT8":
+        var ret pq.Float64Array
+        err := ret.Scan(bytes)
+        return []float64(ret), err
+    case "_BOOL":
+        var ret pq.BoolArray
+        err := ret.Scan(bytes)
+        return []bool(ret), err
+    }
+    return string(bytes), nil
+}
+
+// convert scanned values in place, for MapScan and CustomMapScan
+func naturalValues(rows *sql.Rows, values []interface{}) error {
+    types, err := rows.ColumnTypes()
+    if err != nil {
+        return err
+    }
+    for i, t := range types {
+        if values[i], err = naturalValue(t.DatabaseTypeName(), values[i]); err != nil {
+            return fmt.Errorf("column %s: %v", t.Name(), err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func Test_TypedColumns(t *testing.T) {
+    type profile struct {
+        Age int `json:"age"`
+    }
+    var p JSONB[profile]
+    if err := p.Scan([]byte(`{"age":18}`)); err != nil || !p.Valid || p.Data.Age != 18 {
+        t.Errorf("wrong jsonb scan: %+v %v", p, err)
+    }
+    var tags StringArray
+    if err := tags.Scan([]byte(`{a,"b c"}`)); err != nil || !reflect.DeepEqual(tags, StringArray{"a", "b c"}) {
+        t.Errorf("wrong array scan: %v %v", tags, err)
+    }
+    var deleted NullTime
+    deleted.Scan(nil)
+    var created NullTime
+    created.Scan(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+
+    row := map[string]interface{}{"profile": p, "tags": tags, "deleted": deleted, "created": created, "empty": JSONB[profile]{}}
+    bytes, _ := json.Marshal(row)
+    expected := `{"created":"2020-01-02T00:00:00Z","deleted":null,"empty":null,"profile":{"age":18},"tags":["a","b c"]}`
+    if string(bytes) != expected {
+        t.Errorf("wrong json: %s", bytes)
+    }
+}
+
+func Test_NaturalValue(t *testing.T) {
+    cases := []struct {
+        typeName string
+        raw interface{}
+        expected interface{}
+    }{
+        {"JSONB", []byte(`{"a":[1,2]}`), map[string]interface{}{"a": []interface{}{1.0, 2.0}}},
+        {"_TEXT", []byte(`{x,y}`), []string{"x", "y"}},
+        {"_INT8", []byte(`{1,2}`), []int64{1, 2}},
+        {"NUMERIC", []byte(`3.14`), "3.14"},
+        {"UUID", []byte(`a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11`), "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"},
+        {"BYTEA", []byte{1, 2}, []byte{1, 2}},
+        {"INT8", int64(7), int64(7)},
+        {"JSONB", nil, nil},
+    }
+    for _, c := range cases {
+        if v, err := naturalValue(c.typeName, c.raw); err != nil || !reflect.DeepEqual(v, c.expected) {
+            t.Errorf("%s: got %#v, %v", c.typeName, v, err)
+        }
+    }
+}
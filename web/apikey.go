@@ -0,0 +1,228 @@
+// API key authentication
+
+package web
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "strings"
+import "context"
+import "io/ioutil"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+
+import "github.com/gin-gonic/gin"
+
+/*
+keys are sent by the header X-Api-Key, or the query parameter api_key.
+keys are looked up by their sha256 hash, files and tables never hold raw keys.
+
+usage:
+  keys, _ := web.LoadApiKeyFile("api_keys.json")  // or web.ApiKeysFromEnv(), web.NewPgApiKeyStore(client)
+  r.Use(web.Unless("/login").Then(web.ApiKeyMiddleWare(keys)))
+  r.GET("/users", web.RequireScopes("users:read"), handler)
+
+the scopes of a key are checked by RequireScopes, like the scopes of a JWT.
+*/
+
+const API_KEY_HEADER string = "X-Api-Key"
+const API_KEY_QUERY string = "api_key"
+const apiKeyCtxKey = "api_key"
+
+type ApiKey struct {
+    Id string `json:"id"`
+    Name string `json:"name"`
+    Scopes []string `json:"scopes"`
+    ExpiresAt time.Time `json:"expires_at"`  // zero: never
+    RateLimit int `json:"rate_limit"`  // requests per minute, 0: unlimited
+}
+
+func (that *ApiKey) Expired() bool {
+    return !that.ExpiresAt.IsZero() && time.Now().After(that.ExpiresAt)
+}
+
+type ApiKeyStore interface {
+    // the key of a raw key, nil when unknown
+    Lookup(ctx context.Context, key string) (*ApiKey, error)
+}
+
+// hex sha256 of a key. keys are random, so a fast hash is enough
+func HashApiKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// a random key and its hash
+func GenerateApiKey() (string, string, error) {
+    bytes := make([]byte, 32)
+    if _, err := rand.Read(bytes); err != nil {
+        return "", "", err
+    }
+    key := hex.EncodeToString(bytes)
+    return key, HashApiKey(key), nil
+}
+
+// keys in memory, by hash
+type StaticApiKeys map[string]*ApiKey
+
+func (that StaticApiKeys) Lookup(ctx context.Context, key string) (*ApiKey, error) {
+    return that[HashApiKey(key)], nil
+}
+
+// add a raw key
+func (that StaticApiKeys) Add(key string, apiKey *ApiKey) {
+    that[HashApiKey(key)] = apiKey
+}
+
+/*
+keys of env api_keys, comma separated name=key, optionally with space separated scopes after #:
+  api_keys="backup=3f9a...#users:read files:read, deploy=8c1e..."
+*/
+func ApiKeysFromEnv() StaticApiKeys {
+    keys := make(StaticApiKeys)
+    for _, item := range strings.Split(os.Getenv("api_keys"), ",") {
+        if item = strings.TrimSpace(item); item == "" {
+            continue
+        }
+        var scopes []string
+        if i := strings.Index(item, "#"); i >= 0 {
+            scopes = strings.Fields(item[i + 1:])
+            item = item[:i]
+        }
+        name, key := "", item
+        if i := strings.Index(item, "="); i >= 0 {
+            name, key = item[:i], item[i + 1:]
+        }
+        keys.Add(key, &ApiKey{Id: name, Name: name, Scopes: scopes})
+    }
+    return keys
+}
+
+/*
+load keys from a JSON file:
+  [{"id": "1", "name": "backup", "key_hash": "<HashApiKey>", "scopes": ["users:read"], "expires_at": "2030-01-01T00:00:00Z", "rate_limit": 60}]
+*/
+func LoadApiKeyFile(file string) (StaticApiKeys, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var items []struct {
+        ApiKey
+        KeyHash string `json:"key_hash"`
+    }
+    if err = json.Unmarshal(data, &items); err != nil {
+        return nil, err
+    }
+    keys := make(StaticApiKeys)
+    for i := range items {
+        if items[i].KeyHash == "" {
+            return nil, fmt.Errorf("api key %s: no key_hash", items[i].Id)
+        }
+        keys[strings.ToLower(items[i].KeyHash)] = &items[i].ApiKey
+    }
+    return keys, nil
+}
+
+// fixed window counters of requests per minute
+type rateLimiter struct {
+    mtx sync.Mutex
+    windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+    start time.Time
+    count int
+}
+
+// whether a request is allowed, and the seconds to wait when not
+func (that *rateLimiter) allow(bucket string, limit int) (bool, int) {
+    if limit <= 0 {
+        return true, 0
+    }
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    if that.windows == nil {
+        that.windows = make(map[string]*rateWindow)
+    }
+    now := time.Now()
+    window, ok := that.windows[bucket]
+    if !ok || now.Sub(window.start) >= time.Minute {
+        window = &rateWindow{start: now}
+        that.windows[bucket] = window
+    }
+    if window.count >= limit {
+        return false, int(window.start.Add(time.Minute).Sub(now).Seconds()) + 1
+    }
+    window.count++
+    return true, 0
+}
+
+type ApiKeyAuth struct {
+    Store ApiKeyStore
+    Header string  // default: X-Api-Key
+    Query string  // default: api_key. "-" disables it
+    limiter rateLimiter
+}
+
+// middleware with default header and query names
+func ApiKeyMiddleWare(store ApiKeyStore) gin.HandlerFunc {
+    return (&ApiKeyAuth{Store: store}).Ware
+}
+
+func (that *ApiKeyAuth) extract(c *gin.Context) string {
+    header := that.Header
+    if header == "" {
+        header = API_KEY_HEADER
+    }
+    if key := c.GetHeader(header); key != "" {
+        return key
+    }
+    query := that.Query
+    if query == "" {
+        query = API_KEY_QUERY
+    }
+    if query == "-" {
+        return ""
+    }
+    return c.Query(query)
+}
+
+// middleware. 401 for a missing, unknown or expired key, 429 over the rate limit
+func (that *ApiKeyAuth) Ware(c *gin.Context) {
+    key := that.extract(c)
+    if key == "" {
+        Unauthorized(c, nil)
+        return
+    }
+    apiKey, err := that.Store.Lookup(c.Request.Context(), key)
+    if err != nil {
+        log.Errorf("api key: %v", err)
+        ServiceUnavailable(c, nil)
+        return
+    }
+    if apiKey == nil || apiKey.Expired() {
+        Unauthorized(c, nil)
+        return
+    }
+    // by the hash, keys without an id must not share a bucket
+    if ok, wait := that.limiter.allow(HashApiKey(key), apiKey.RateLimit); !ok {
+        c.Header("Retry-After", fmt.Sprint(wait))
+        TooManyRequests(c, nil)
+        return
+    }
+    c.Set(apiKeyCtxKey, apiKey)
+    c.Set(authSubjectKey, &AuthSubject{Id: apiKey.Id, Scopes: apiKey.Scopes})
+    c.Next()
+}
+
+// the key of the request, nil when not authenticated by a key
+func CurrentApiKey(c *gin.Context) *ApiKey {
+    if v, ok := c.Get(apiKeyCtxKey); ok {
+        return v.(*ApiKey)
+    }
+    return nil
+}
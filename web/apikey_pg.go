@@ -0,0 +1,104 @@
+// API keys in a postgresql table
+
+package web
+
+import "fmt"
+import "time"
+import "context"
+import "database/sql"
+
+import "github.com/google/uuid"
+import "github.com/jackielihf/golib/storage"
+
+/*
+usage:
+  keys := web.NewPgApiKeyStore(client)
+  keys.CreateTable(ctx)
+  key, apiKey, err := keys.Create(ctx, "backup", []string{"users:read"}, time.Time{}, 60)  // the raw key is only returned here
+  r.Use(web.ApiKeyMiddleWare(keys))
+*/
+
+type PgApiKeyStore struct {
+    Client *storage.PgClient
+    Table string  // default: api_keys
+}
+
+func NewPgApiKeyStore(client *storage.PgClient) *PgApiKeyStore {
+    return &PgApiKeyStore{Client: client, Table: "api_keys"}
+}
+
+func (that *PgApiKeyStore) table() string {
+    if that.Table == "" {
+        return "api_keys"
+    }
+    return that.Table
+}
+
+// create the table if not exists
+func (that *PgApiKeyStore) CreateTable(ctx context.Context) error {
+    _, err := that.Client.Db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+        id varchar(64) primary key,
+        name varchar(255) not null,
+        key_hash char(64) not null unique,
+        scopes text[] not null default '{}',
+        expires_at timestamptz,
+        rate_limit integer not null default 0,
+        revoked_at timestamptz,
+        created_at timestamptz not null default now()
+    )`, that.table()))
+    return err
+}
+
+// create a key. the raw key is returned once, only its hash is stored
+func (that *PgApiKeyStore) Create(ctx context.Context, name string, scopes []string, expiresAt time.Time, rateLimit int) (string, *ApiKey, error) {
+    key, hash, err := GenerateApiKey()
+    if err != nil {
+        return "", nil, err
+    }
+    apiKey := &ApiKey{Id: uuid.New().String(), Name: name, Scopes: scopes, ExpiresAt: expiresAt, RateLimit: rateLimit}
+    fields := map[string]interface{}{
+        "id": apiKey.Id,
+        "name": name,
+        "key_hash": hash,
+        "scopes": storage.StringArray(scopes),
+        "rate_limit": rateLimit,
+    }
+    if !expiresAt.IsZero() {
+        fields["expires_at"] = expiresAt
+    }
+    if err = that.Client.InsertContext(ctx, that.table(), fields, "", nil); err != nil {
+        return "", nil, err
+    }
+    return key, apiKey, nil
+}
+
+func (that *PgApiKeyStore) Lookup(ctx context.Context, key string) (*ApiKey, error) {
+    apiKey := new(ApiKey)
+    var scopes storage.StringArray
+    var expiresAt sql.NullTime
+    query := fmt.Sprintf("select id, name, scopes, expires_at, rate_limit from %s where key_hash = ? and revoked_at is null", that.table())
+    n, err := that.Client.SelectOneContext(ctx, query, storage.FieldMapping{
+        "id": &apiKey.Id,
+        "name": &apiKey.Name,
+        "scopes": &scopes,
+        "expires_at": &expiresAt,
+        "rate_limit": &apiKey.RateLimit,
+    }, HashApiKey(key))
+    if err != nil || n == 0 {
+        return nil, err
+    }
+    apiKey.Scopes = scopes
+    if expiresAt.Valid {
+        apiKey.ExpiresAt = expiresAt.Time
+    }
+    return apiKey, nil
+}
+
+// revoke a key by id
+func (that *PgApiKeyStore) Revoke(ctx context.Context, id string) error {
+    affected, err := that.Client.UpdateContext(ctx, that.table(), map[string]interface{}{"revoked_at": time.Now()}, "id = ? and revoked_at is null", id)
+    if err == nil && affected == 0 {
+        return storage.ErrNotFound
+    }
+    return err
+}
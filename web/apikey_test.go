@@ -0,0 +1,94 @@
+package web
+
+import "testing"
+import "os"
+import "context"
+import "time"
+import "path/filepath"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+
+func Test_ApiKey(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "keys.json")
+    os.WriteFile(file, []byte(`[
+        {"id": "1", "key_hash": "` + HashApiKey("k1") + `", "scopes": ["users:read"], "rate_limit": 2},
+        {"id": "2", "key_hash": "` + HashApiKey("k2") + `", "expires_at": "2000-01-01T00:00:00Z"}
+    ]`), 0644)
+    keys, err := LoadApiKeyFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keys.Add("k3", &ApiKey{Id: "3", ExpiresAt: time.Now().Add(time.Hour)})
+
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.Use(Unless("/public").Then(ApiKeyMiddleWare(keys)))
+    ok := func(c *gin.Context) { c.String(200, CurrentApiKey(c).Id) }
+    r.GET("/users", RequireScopes("users:read"), ok)
+    r.GET("/public", func(c *gin.Context) { c.String(200, "") })
+
+    get := func(path string, key string) int {
+        req := httptest.NewRequest("GET", path, nil)
+        if key != "" {
+            req.Header.Set(API_KEY_HEADER, key)
+        }
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+    cases := []struct {
+        path string
+        key string
+        code int
+    }{
+        {"/users", "k1", 200},
+        {"/users?api_key=k1", "", 200},
+        {"/users", "k1", 429},  // rate limit 2 per minute
+        {"/users", "k2", 401},  // expired
+        {"/users", "k3", 403},  // no scope
+        {"/users", "unknown", 401},
+        {"/users", "", 401},
+        {"/public", "", 200},
+    }
+    for _, c := range cases {
+        if code := get(c.path, c.key); code != c.code {
+            t.Errorf("%s %s: expected %d, got %d", c.path, c.key, c.code, code)
+        }
+    }
+}
+
+func Test_ApiKeyRateBuckets(t *testing.T) {
+    // env keys without a name have no id
+    keys := make(StaticApiKeys)
+    keys.Add("k1", &ApiKey{RateLimit: 1})
+    keys.Add("k2", &ApiKey{RateLimit: 1})
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.Use(ApiKeyMiddleWare(keys))
+    r.GET("/", func(c *gin.Context) { c.String(200, "") })
+    get := func(key string) int {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.Header.Set(API_KEY_HEADER, key)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+    if get("k1") != 200 || get("k2") != 200 {
+        t.Error("keys without an id should not share a rate bucket")
+    }
+    if code := get("k1"); code != 429 {
+        t.Errorf("should be limited per key, got %d", code)
+    }
+}
+
+func Test_ApiKeysFromEnv(t *testing.T) {
+    t.Setenv("api_keys", "backup=abc#users:read files:read, deploy=def")
+    keys := ApiKeysFromEnv()
+    if key, _ := keys.Lookup(context.Background(), "abc"); key == nil || key.Name != "backup" || len(key.Scopes) != 2 {
+        t.Errorf("wrong key: %+v", key)
+    }
+    if key, _ := keys.Lookup(context.Background(), "def"); key == nil || key.Name != "deploy" {
+        t.Errorf("wrong key: %+v", key)
+    }
+}
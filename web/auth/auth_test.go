@@ -0,0 +1,153 @@
+package auth
+
+import "testing"
+import "strings"
+import "time"
+import "sync"
+import "sync/atomic"
+import "context"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+import "golang.org/x/crypto/bcrypt"
+
+// cheap parameters, tests only
+var testParams = Argon2Params{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func Test_Hasher(t *testing.T) {
+    hasher := &Hasher{Argon2: testParams}
+    hasher.Init()
+    hash, err := hasher.Hash("pa55word")
+    if err != nil || !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+        t.Fatalf("wrong argon2id hash: %s %v", hash, err)
+    }
+    if ok, outdated, err := hasher.Verify("pa55word", hash); !ok || outdated || err != nil {
+        t.Errorf("should verify: %v %v %v", ok, outdated, err)
+    }
+    if ok, _, _ := hasher.Verify("wrong", hash); ok {
+        t.Error("wrong password should not verify")
+    }
+    if _, _, err := hasher.Verify("pa55word", "plain"); err != ErrUnknownHash {
+        t.Errorf("unknown hash should fail: %v", err)
+    }
+
+    // stronger parameters outdate the hash
+    stronger := &Hasher{Argon2: Argon2Params{Memory: 2048, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}}
+    stronger.Init()
+    if ok, outdated, _ := stronger.Verify("pa55word", hash); !ok || !outdated {
+        t.Errorf("weaker hash should be outdated: %v %v", ok, outdated)
+    }
+
+    // bcrypt hashes verify, and are outdated for argon2id
+    bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+    if ok, outdated, err := hasher.Verify("pa55word", string(bcryptHash)); !ok || !outdated || err != nil {
+        t.Errorf("bcrypt hash should verify and be outdated: %v %v %v", ok, outdated, err)
+    }
+    bcryptHasher := &Hasher{Alg: BCRYPT, BcryptCost: bcrypt.MinCost}
+    bcryptHasher.Init()
+    if ok, outdated, _ := bcryptHasher.Verify("pa55word", string(bcryptHash)); !ok || outdated {
+        t.Errorf("bcrypt hash should be current: %v %v", ok, outdated)
+    }
+}
+
+func Test_Throttle(t *testing.T) {
+    throttle := &Throttle{MaxFailures: 2, MaxIpFailures: 3, Lockout: time.Minute}
+    throttle.Init()
+    // attempts count until Reset
+    if ok, _ := throttle.Allow("alice", "10.0.0.1"); !ok {
+        t.Error("should allow under the limit")
+    }
+    throttle.Allow("alice", "10.0.0.1")
+    if ok, wait := throttle.Allow("alice", "10.0.0.2"); ok || wait <= 0 || wait > time.Minute {
+        t.Errorf("account should be locked: %v %v", ok, wait)
+    }
+    // a login into one's own account takes back its attempt only, not the failures of the IP
+    throttle.Allow("dave", "10.0.0.1")
+    throttle.Reset("dave", "10.0.0.1")
+    // spraying other accounts from one IP
+    throttle.Allow("bob", "10.0.0.1")
+    if ok, _ := throttle.Allow("carol", "10.0.0.1"); ok {
+        t.Error("IP should be locked")
+    }
+    throttle.Reset("alice", "10.0.0.2")
+    if ok, _ := throttle.Allow("alice", "10.0.0.2"); !ok {
+        t.Error("reset account should be allowed")
+    }
+    if ok, _ := throttle.Allow("carol", "10.0.0.1"); ok {
+        t.Error("reset should not unlock the IP")
+    }
+}
+
+func Test_ThrottleParallel(t *testing.T) {
+    throttle := &Throttle{MaxFailures: 3, Lockout: time.Minute}
+    throttle.Init()
+    var allowed int64
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if ok, _ := throttle.Allow("alice", "10.0.0.1"); ok {
+                atomic.AddInt64(&allowed, 1)
+            }
+        }()
+    }
+    wg.Wait()
+    if allowed != 3 {
+        t.Errorf("parallel attempts should be counted up front, %d allowed", allowed)
+    }
+    throttle.Undo("alice", "10.0.0.1")
+    if ok, _ := throttle.Allow("alice", "10.0.0.1"); !ok {
+        t.Error("an undone attempt should not count")
+    }
+}
+
+func Test_Login(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    // an old bcrypt hash, upgraded on login
+    bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+    users := NewMemoryUserStore()
+    users.Add("Alice", &User{Id: "1", PasswordHash: string(bcryptHash)})
+    hasher := &Hasher{Argon2: testParams}
+    hasher.Init()
+    throttle := &Throttle{MaxFailures: 2, Lockout: time.Minute}
+    throttle.Init()
+    login := &Login{Users: users, Hasher: hasher, Throttle: throttle}
+    login.Init()
+    r := gin.New()
+    r.POST("/login", login.LoginHandler)
+    r.POST("/logout", login.LogoutHandler)
+
+    post := func(path string, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", path, strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w
+    }
+    w := post("/login", `{"username": "alice", "password": "pa55word"}`)
+    if w.Code != 200 || !strings.Contains(w.Header().Get("Set-Cookie"), "JWT_TOKEN=") {
+        t.Fatalf("should log in: %d %s", w.Code, w.Body.String())
+    }
+    user, _ := users.FindUser(context.Background(), "alice")
+    if !strings.HasPrefix(user.PasswordHash, "$argon2id$") {
+        t.Errorf("hash should be upgraded: %s", user.PasswordHash)
+    }
+    if w = post("/login", `{"username": "alice"}`); w.Code != 400 {
+        t.Errorf("missing password should respond 400, got %d", w.Code)
+    }
+    if w = post("/login", `{"username": "nobody", "password": "x"}`); w.Code != 401 {
+        t.Errorf("unknown user should respond 401, got %d", w.Code)
+    }
+    post("/login", `{"username": "alice", "password": "wrong"}`)
+    if w = post("/login", `{"username": "alice", "password": "wrong"}`); w.Code != 401 {
+        t.Errorf("wrong password should respond 401, got %d", w.Code)
+    }
+    if w = post("/login", `{"username": "alice", "password": "pa55word"}`); w.Code != 429 || w.Header().Get("Retry-After") == "" {
+        t.Errorf("locked account should respond 429, got %d", w.Code)
+    }
+    w = post("/logout", "")
+    if w.Code != 200 || !strings.Contains(w.Header().Get("Set-Cookie"), "JWT_TOKEN=;") {
+        t.Errorf("logout should clear the cookie: %d %v", w.Code, w.Header().Values("Set-Cookie"))
+    }
+}
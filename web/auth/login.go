@@ -0,0 +1,186 @@
+// login and logout handlers
+
+package auth
+
+import "fmt"
+import "sync"
+import "strings"
+import "context"
+
+import "github.com/gin-gonic/gin"
+import "github.com/jackielihf/golib"
+import "github.com/jackielihf/golib/web"
+
+var log = golib.Logger()
+
+/*
+usage:
+  login := auth.NewLogin(users)  // users: an auth.UserStore
+  r.POST("/login", login.LoginHandler)
+  r.POST("/logout", login.LogoutHandler)
+  r.Use(web.Unless("/login").Then(web.JwtMiddleWare()))
+
+the login handler reads username and password from a JSON or form body, and responds:
+  200 with the user's id, and the JWT cookie set by web.JwtSetCookie
+  400 without username or password
+  401 for an unknown user or a wrong password, the same for both
+  429 with Retry-After when the account or IP is throttled
+
+the IP is c.ClientIP(), configure engine.SetTrustedProxies, or a spoofed X-Forwarded-For defeats the IP limit.
+*/
+
+type User struct {
+    Id string
+    PasswordHash string
+    Payload interface{}  // signed into the JWT. default: {"id": Id, "username": username}
+}
+
+type UserStore interface {
+    // the user of a username, nil when unknown
+    FindUser(ctx context.Context, username string) (*User, error)
+    // replace an outdated hash, after a successful login
+    UpdatePasswordHash(ctx context.Context, id string, hash string) error
+}
+
+type Login struct {
+    Users UserStore
+    Hasher *Hasher  // default: env settings
+    Throttle *Throttle  // default: env settings
+
+    dummyOnce sync.Once
+    dummyHash string
+}
+
+func NewLogin(users UserStore) *Login {
+    obj := &Login{Users: users}
+    obj.Init()
+    return obj
+}
+
+func (obj *Login) Init() {
+    if obj.Hasher == nil {
+        obj.Hasher = NewHasher()
+    }
+    if obj.Throttle == nil {
+        obj.Throttle = NewThrottle()
+    }
+}
+
+// a hash to verify against for unknown users, so they take as long as known ones
+func (obj *Login) dummy() string {
+    obj.dummyOnce.Do(func(){
+        obj.dummyHash, _ = obj.Hasher.Hash("dummy password")
+    })
+    return obj.dummyHash
+}
+
+// the user of the credentials, nil when they don't match
+func (obj *Login) Authenticate(ctx context.Context, username string, password string) (*User, error) {
+    user, err := obj.Users.FindUser(ctx, username)
+    if err != nil {
+        return nil, err
+    }
+    if user == nil {
+        obj.Hasher.Verify(password, obj.dummy())
+        return nil, nil
+    }
+    ok, outdated, err := obj.Hasher.Verify(password, user.PasswordHash)
+    if err != nil || !ok {
+        return nil, err
+    }
+    if outdated {
+        // upgrade on login, a failure keeps the old hash
+        if hash, err := obj.Hasher.Hash(password); err == nil {
+            err = obj.Users.UpdatePasswordHash(ctx, user.Id, hash)
+        }
+        if err != nil {
+            log.Errorf("auth: upgrade password hash of %s: %v", user.Id, err)
+        }
+    }
+    return user, nil
+}
+
+// handler
+func (obj *Login) LoginHandler(c *gin.Context) {
+    var body struct {
+        Username string `json:"username" form:"username"`
+        Password string `json:"password" form:"password"`
+    }
+    c.ShouldBind(&body)
+    username := strings.ToLower(strings.TrimSpace(body.Username))
+    if username == "" || body.Password == "" {
+        web.BadRequest(c, nil)
+        return
+    }
+    ip := c.ClientIP()
+    if ok, wait := obj.Throttle.Allow(username, ip); !ok {
+        log.Warnf("auth: login of %s from %s throttled", username, ip)
+        c.Header("Retry-After", fmt.Sprint(int(wait.Seconds()) + 1))
+        web.TooManyRequests(c, nil)
+        return
+    }
+    user, err := obj.Authenticate(c.Request.Context(), username, body.Password)
+    if err != nil {
+        obj.Throttle.Undo(username, ip)
+        log.Errorf("auth: %v", err)
+        web.ServiceUnavailable(c, nil)
+        return
+    }
+    if user == nil {
+        // the attempt counted by Allow stays
+        web.Unauthorized(c, nil)
+        return
+    }
+    obj.Throttle.Reset(username, ip)
+    payload := user.Payload
+    if payload == nil {
+        payload = map[string]string{"id": user.Id, "username": username}
+    }
+    web.JwtSetCookie(c, payload)
+    web.Success(c, gin.H{"id": user.Id})
+}
+
+// handler. clears the JWT cookies, their sessions are revoked only when web.JwtUseSessions is configured
+func (obj *Login) LogoutHandler(c *gin.Context) {
+    web.JwtClearCookie(c)
+    web.Success(c, nil)
+}
+
+// users in memory, by lowercase username. for examples and tests
+type MemoryUserStore struct {
+    mtx sync.RWMutex
+    users map[string]*User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+    return &MemoryUserStore{users: make(map[string]*User)}
+}
+
+// add a user with a password hash, see HashPassword
+func (that *MemoryUserStore) Add(username string, user *User) {
+    that.mtx.Lock()
+    that.users[strings.ToLower(username)] = user
+    that.mtx.Unlock()
+}
+
+func (that *MemoryUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+    that.mtx.RLock()
+    defer that.mtx.RUnlock()
+    if user, ok := that.users[strings.ToLower(username)]; ok {
+        copied := *user
+        return &copied, nil
+    }
+    return nil, nil
+}
+
+func (that *MemoryUserStore) UpdatePasswordHash(ctx context.Context, id string, hash string) error {
+    that.mtx.Lock()
+    defer that.mtx.Unlock()
+    for _, user := range that.users {
+        if user.Id == id {
+            user.PasswordHash = hash
+            return nil
+        }
+    }
+    return fmt.Errorf("auth: no user %s", id)
+}
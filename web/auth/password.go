@@ -0,0 +1,162 @@
+// password hashing: argon2id and bcrypt
+
+package auth
+
+import "os"
+import "fmt"
+import "sync"
+import "errors"
+import "strings"
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/base64"
+
+import "golang.org/x/crypto/argon2"
+import "golang.org/x/crypto/bcrypt"
+
+/*
+hashes are self-describing strings, so argon2id and bcrypt hashes can live in the same column:
+  $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+  $2a$12$<salt and hash>
+
+Verify tells when a hash is outdated, i.e. another algorithm or weaker parameters,
+so it can be upgraded at login, when the plain password is at hand.
+
+env variables:
+  auth_password_hash  argon2id(default), bcrypt
+*/
+
+const (
+    ARGON2ID string = "argon2id"
+    BCRYPT string = "bcrypt"
+)
+
+var ErrUnknownHash = errors.New("err: unknown password hash")
+
+type Argon2Params struct {
+    Memory uint32  // KiB
+    Time uint32  // iterations
+    Threads uint8
+    SaltLen uint32
+    KeyLen uint32
+}
+
+// OWASP recommended minimum is m=19456,t=2,p=1
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLen: 16, KeyLen: 32}
+
+type Hasher struct {
+    Alg string  // default: env auth_password_hash, or argon2id
+    Argon2 Argon2Params  // default: DefaultArgon2Params
+    BcryptCost int  // default: 12
+}
+
+func NewHasher() *Hasher {
+    obj := new(Hasher)
+    obj.Init()
+    return obj
+}
+
+func (obj *Hasher) Init() {
+    if obj.Alg == "" {
+        obj.Alg = strings.ToLower(os.Getenv("auth_password_hash"))
+    }
+    if obj.Alg != BCRYPT {
+        obj.Alg = ARGON2ID
+    }
+    if obj.Argon2.Memory == 0 {
+        obj.Argon2 = DefaultArgon2Params
+    }
+    if obj.BcryptCost < bcrypt.MinCost {
+        obj.BcryptCost = 12
+    }
+}
+
+func (obj *Hasher) Hash(password string) (string, error) {
+    if obj.Alg == BCRYPT {
+        hash, err := bcrypt.GenerateFromPassword([]byte(password), obj.BcryptCost)
+        return string(hash), err
+    }
+    p := obj.Argon2
+    salt := make([]byte, p.SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+        base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// whether the password matches, and whether the hash should be replaced by Hash(password)
+func (obj *Hasher) Verify(password string, hash string) (bool, bool, error) {
+    if strings.HasPrefix(hash, "$argon2id$") {
+        p, salt, key, err := decodeArgon2(hash)
+        if err != nil {
+            return false, false, err
+        }
+        other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+        if subtle.ConstantTimeCompare(key, other) != 1 {
+            return false, false, nil
+        }
+        current := obj.Argon2
+        outdated := obj.Alg != ARGON2ID || p.Memory < current.Memory || p.Time < current.Time ||
+            p.Threads < current.Threads || uint32(len(salt)) < current.SaltLen || uint32(len(key)) < current.KeyLen
+        return true, outdated, nil
+    }
+    if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+        err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+        if err == bcrypt.ErrMismatchedHashAndPassword {
+            return false, false, nil
+        }
+        if err != nil {
+            return false, false, err
+        }
+        cost, _ := bcrypt.Cost([]byte(hash))
+        return true, obj.Alg != BCRYPT || cost < obj.BcryptCost, nil
+    }
+    return false, false, ErrUnknownHash
+}
+
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+    var p Argon2Params
+    parts := strings.Split(hash, "$")
+    // "", argon2id, v=19, m=..,t=..,p=.., salt, key
+    if len(parts) != 6 {
+        return p, nil, nil, ErrUnknownHash
+    }
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return p, nil, nil, ErrUnknownHash
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+        return p, nil, nil, ErrUnknownHash
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return p, nil, nil, ErrUnknownHash
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(key) == 0 {
+        return p, nil, nil, ErrUnknownHash
+    }
+    return p, salt, key, nil
+}
+
+var defaultHasher *Hasher
+var once sync.Once
+
+func getHasher() *Hasher {
+    once.Do(func(){
+        defaultHasher = NewHasher()
+    })
+    return defaultHasher
+}
+
+// hash with the env settings
+func HashPassword(password string) (string, error) {
+    return getHasher().Hash(password)
+}
+
+// verify with the env settings, see Hasher.Verify
+func VerifyPassword(password string, hash string) (bool, bool, error) {
+    return getHasher().Verify(password, hash)
+}
@@ -0,0 +1,145 @@
+// login attempt throttling
+
+package auth
+
+import "os"
+import "sync"
+import "time"
+import "strconv"
+
+/*
+login attempts are counted per account and per client IP within a window.
+an account or IP over its limit is locked until the window of its first attempt ends.
+Allow counts the attempt up front, so parallel requests can't all pass before the slow
+password check fails, and a successful login takes it back by Reset.
+Reset clears the account, but the IP keeps its other failures: otherwise logging into
+one's own account between guesses would make password spraying from one IP unlimited.
+the IP limit is higher, so that users behind one NAT don't lock each other out.
+
+the IP is what the caller passes, e.g. gin's c.ClientIP(). gin trusts X-Forwarded-For from
+any proxy by default, which lets clients pick their IP: configure engine.SetTrustedProxies.
+
+env variables:
+  auth_max_failures     failures per account, default: 5
+  auth_max_ip_failures  failures per IP, default: 20
+  auth_lockout          seconds of the window, default: 900
+*/
+
+type Throttle struct {
+    MaxFailures int  // default: env auth_max_failures, or 5
+    MaxIpFailures int  // default: env auth_max_ip_failures, or 20
+    Lockout time.Duration  // default: env auth_lockout, or 15 minutes
+
+    mtx sync.Mutex
+    failures map[string]*failureWindow
+    pruned time.Time
+}
+
+type failureWindow struct {
+    start time.Time
+    count int
+}
+
+func NewThrottle() *Throttle {
+    obj := new(Throttle)
+    obj.Init()
+    return obj
+}
+
+func envInt(key string, defaultValue int) int {
+    if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+        return v
+    }
+    return defaultValue
+}
+
+func (obj *Throttle) Init() {
+    if obj.MaxFailures < 1 {
+        obj.MaxFailures = envInt("auth_max_failures", 5)
+    }
+    if obj.MaxIpFailures < 1 {
+        obj.MaxIpFailures = envInt("auth_max_ip_failures", 20)
+    }
+    if obj.Lockout <= 0 {
+        obj.Lockout = time.Duration(envInt("auth_lockout", 900)) * time.Second
+    }
+    obj.failures = make(map[string]*failureWindow)
+}
+
+// the live window of a key, nil when none
+func (obj *Throttle) window(key string, now time.Time) *failureWindow {
+    window, ok := obj.failures[key]
+    if !ok {
+        return nil
+    }
+    if now.Sub(window.start) >= obj.Lockout {
+        delete(obj.failures, key)
+        return nil
+    }
+    return window
+}
+
+// whether the account and IP may try to log in, and how long to wait when not.
+// an allowed attempt is counted as a failure until Reset
+func (obj *Throttle) Allow(account string, ip string) (bool, time.Duration) {
+    obj.mtx.Lock()
+    defer obj.mtx.Unlock()
+    now := time.Now()
+    var wait time.Duration
+    check := func(key string, limit int) {
+        if window := obj.window(key, now); window != nil && window.count >= limit {
+            if left := window.start.Add(obj.Lockout).Sub(now); left > wait {
+                wait = left
+            }
+        }
+    }
+    check("a:" + account, obj.MaxFailures)
+    check("i:" + ip, obj.MaxIpFailures)
+    if wait > 0 {
+        return false, wait
+    }
+    for _, key := range []string{"a:" + account, "i:" + ip} {
+        window := obj.window(key, now)
+        if window == nil {
+            window = &failureWindow{start: now}
+            obj.failures[key] = window
+        }
+        window.count++
+    }
+    obj.prune(now)
+    return true, 0
+}
+
+// after a successful login: forget the failures of the account, and take back the attempt of the IP
+func (obj *Throttle) Reset(account string, ip string) {
+    obj.mtx.Lock()
+    defer obj.mtx.Unlock()
+    delete(obj.failures, "a:" + account)
+    obj.uncount("i:" + ip)
+}
+
+// take back an attempt that didn't fail, e.g. the user store was unavailable
+func (obj *Throttle) Undo(account string, ip string) {
+    obj.mtx.Lock()
+    defer obj.mtx.Unlock()
+    obj.uncount("a:" + account)
+    obj.uncount("i:" + ip)
+}
+
+// the lock must be held
+func (obj *Throttle) uncount(key string) {
+    if window := obj.window(key, time.Now()); window != nil && window.count > 0 {
+        window.count--
+    }
+}
+
+// drop ended windows, at most once a window
+func (obj *Throttle) prune(now time.Time) {
+    if now.Sub(obj.pruned) < obj.Lockout {
+        return
+    }
+    obj.pruned = now
+    for key := range obj.failures {
+        obj.window(key, now)
+    }
+}
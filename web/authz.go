@@ -0,0 +1,198 @@
+// authorization by roles, scopes and permissions of JWT claims
+
+package web
+
+import "io/ioutil"
+import "sync"
+import "strings"
+import "encoding/json"
+
+import "github.com/gin-gonic/gin"
+
+/*
+roles and scopes are read from the payload of the JWT, after JwtMiddleWare:
+  {"id": "1", "roles": ["admin"], "scope": "users:read users:write"}
+arrays, and space or comma separated strings are both accepted.
+
+usage:
+  r.Use(web.JwtMiddleWare())
+  r.DELETE("/users/:id", web.RequireRoles("admin"), handler)
+  r.GET("/users", web.RequireScopes("users:read"), handler)
+
+  // in web.Api config
+  web.Api{"GET", "/report", web.ApiHandlers{report}}.Use(web.RequireRoles("admin", "auditor"))
+
+  // rbac: role -> permissions, from a JSON file like {"admin": ["*"], "editor": ["posts:*", "users:read"]}
+  rbac, err := web.LoadRBAC("rbac.json")
+  r.POST("/posts", rbac.RequirePermissions("posts:write"), handler)
+
+no claims responds 401, missing roles or permissions respond 403.
+*/
+
+// payload fields of roles and scopes
+var RolesClaim = "roles"
+var ScopesClaim = "scope"
+
+const authSubjectKey = "auth_subject"
+
+type AuthSubject struct {
+    Id string  // sub claim
+    Roles []string
+    Scopes []string
+    Claims *MyClaims
+}
+
+func (that *AuthSubject) HasRole(role string) bool {
+    return contains(that.Roles, role)
+}
+
+func (that *AuthSubject) HasScope(scope string) bool {
+    return contains(that.Scopes, scope)
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// strings of an array, or a space or comma separated string
+func claimStrings(v interface{}) []string {
+    var ret []string
+    switch value := v.(type) {
+    case string:
+        ret = strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+    case []interface{}:
+        for _, item := range value {
+            if s, ok := item.(string); ok {
+                ret = append(ret, s)
+            }
+        }
+    }
+    return ret
+}
+
+// subject of the request's token, nil when not authenticated
+func CurrentSubject(c *gin.Context) *AuthSubject {
+    if v, ok := c.Get(authSubjectKey); ok {
+        return v.(*AuthSubject)
+    }
+    claims, ok := JwtRawClaims(c)
+    if !ok {
+        return nil
+    }
+    subject := &AuthSubject{Id: claims.Subject, Claims: claims}
+    var payload map[string]interface{}
+    if json.Unmarshal([]byte(claims.Payload), &payload) == nil {
+        subject.Roles = claimStrings(payload[RolesClaim])
+        subject.Scopes = claimStrings(payload[ScopesClaim])
+    }
+    c.Set(authSubjectKey, subject)
+    return subject
+}
+
+// policy hook. the request goes on when policy returns true, otherwise 403
+func Authorize(policy func(c *gin.Context, subject *AuthSubject) bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        subject := CurrentSubject(c)
+        if subject == nil {
+            Unauthorized(c, nil)
+            return
+        }
+        if !policy(c, subject) {
+            Forbidden(c, nil)
+            return
+        }
+        c.Next()
+    }
+}
+
+// any of the roles
+func RequireRoles(roles ...string) gin.HandlerFunc {
+    return Authorize(func(c *gin.Context, subject *AuthSubject) bool {
+        for _, role := range roles {
+            if subject.HasRole(role) {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+// all of the scopes
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+    return Authorize(func(c *gin.Context, subject *AuthSubject) bool {
+        for _, scope := range scopes {
+            if !subject.HasScope(scope) {
+                return false
+            }
+        }
+        return true
+    })
+}
+
+// role -> permissions. "*" grants everything, "posts:*" grants permissions prefixed by "posts:"
+type RBAC struct {
+    mtx sync.RWMutex
+    roles map[string][]string
+}
+
+func NewRBAC(model map[string][]string) *RBAC {
+    return &RBAC{roles: model}
+}
+
+// load the model from a JSON file
+func LoadRBAC(file string) (*RBAC, error) {
+    rbac := new(RBAC)
+    if err := rbac.Load(file); err != nil {
+        return nil, err
+    }
+    return rbac, nil
+}
+
+// replace the model with a JSON file
+func (that *RBAC) Load(file string) error {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return err
+    }
+    var model map[string][]string
+    if err = json.Unmarshal(data, &model); err != nil {
+        return err
+    }
+    that.mtx.Lock()
+    that.roles = model
+    that.mtx.Unlock()
+    return nil
+}
+
+func (that *RBAC) Can(roles []string, permission string) bool {
+    that.mtx.RLock()
+    defer that.mtx.RUnlock()
+    for _, role := range roles {
+        for _, granted := range that.roles[role] {
+            if granted == "*" || granted == permission {
+                return true
+            }
+            if strings.HasSuffix(granted, "*") && strings.HasPrefix(permission, granted[:len(granted) - 1]) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// all of the permissions, granted by any of the subject's roles
+func (that *RBAC) RequirePermissions(permissions ...string) gin.HandlerFunc {
+    return Authorize(func(c *gin.Context, subject *AuthSubject) bool {
+        for _, permission := range permissions {
+            if !that.Can(subject.Roles, permission) {
+                return false
+            }
+        }
+        return true
+    })
+}
@@ -0,0 +1,45 @@
+package web
+
+import "testing"
+import "context"
+import "os"
+import "path/filepath"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+
+func Test_Authorization(t *testing.T) {
+    obj := &Jwt{Secret: "secret"}
+    obj.Init()
+    file := filepath.Join(t.TempDir(), "rbac.json")
+    os.WriteFile(file, []byte(`{"admin": ["*"], "editor": ["posts:*", "users:read"]}`), 0644)
+    rbac, err := LoadRBAC(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    ok := func(c *gin.Context) { c.String(200, "ok") }
+    CreateApi(r, []Api{
+        Api{"GET", "/admin", ApiHandlers{ok}}.Use(obj.Ware, RequireRoles("admin")),
+        Api{"GET", "/read", ApiHandlers{ok}}.Use(obj.Ware, RequireScopes("users:read", "posts:read")),
+        Api{"GET", "/posts", ApiHandlers{ok}}.Use(obj.Ware, rbac.RequirePermissions("posts:write")),
+        Api{"GET", "/users", ApiHandlers{ok}}.Use(obj.Ware, rbac.RequirePermissions("users:write")),
+        Api{"GET", "/anonymous", ApiHandlers{ok}}.Use(RequireRoles("admin")),
+    })
+    token, _ := obj.Issue(context.Background(), map[string]interface{}{
+        "roles": []string{"editor"},
+        "scope": "users:read posts:read",
+    })
+    cases := map[string]int{"/admin": 403, "/read": 200, "/posts": 200, "/users": 403, "/anonymous": 401}
+    for path, code := range cases {
+        req := httptest.NewRequest("GET", path, nil)
+        req.Header.Set("Authorization", "Bearer " + token)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        if w.Code != code {
+            t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+        }
+    }
+}
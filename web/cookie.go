@@ -0,0 +1,104 @@
+// cookie policy shared by JWT and usertrack cookies
+
+package web
+
+import "os"
+import "strconv"
+import "strings"
+import "net/http"
+
+import "github.com/gin-gonic/gin"
+
+/*
+env variables:
+  cookie_path         default: /
+  cookie_domain       default: empty, the JWT cookies use jwt_domain then
+  cookie_secure       default: false
+  cookie_http_only    default: true
+  cookie_same_site    lax(default), strict, none
+  cookie_host_prefix  prefix names with __Host-, which implies secure, path / and no domain. default: false
+*/
+
+type CookiePolicy struct {
+    Path string
+    Domain string
+    Secure bool
+    HttpOnly bool
+    SameSite http.SameSite
+    HostPrefix bool
+}
+
+const hostPrefix = "__Host-"
+
+func CookiePolicyFromEnv() CookiePolicy {
+    policy := CookiePolicy{
+        Path: os.Getenv("cookie_path"),
+        Domain: os.Getenv("cookie_domain"),
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+    }
+    if policy.Path == "" {
+        policy.Path = "/"
+    }
+    if v, err := strconv.ParseBool(os.Getenv("cookie_secure")); err == nil {
+        policy.Secure = v
+    }
+    if v, err := strconv.ParseBool(os.Getenv("cookie_http_only")); err == nil {
+        policy.HttpOnly = v
+    }
+    if v, err := strconv.ParseBool(os.Getenv("cookie_host_prefix")); err == nil {
+        policy.HostPrefix = v
+    }
+    switch strings.ToLower(os.Getenv("cookie_same_site")) {
+    case "strict":
+        policy.SameSite = http.SameSiteStrictMode
+    case "none":
+        policy.SameSite = http.SameSiteNoneMode
+        // browsers reject SameSite=None without Secure
+        policy.Secure = true
+    }
+    return policy
+}
+
+// name of the cookie, with the __Host- prefix when enabled
+func (that CookiePolicy) Name(name string) string {
+    if that.HostPrefix {
+        return hostPrefix + name
+    }
+    return name
+}
+
+func (that CookiePolicy) cookie(name string, value string, maxAge int) *http.Cookie {
+    cookie := &http.Cookie{
+        Name: that.Name(name),
+        Value: value,
+        MaxAge: maxAge,
+        Path: that.Path,
+        Domain: that.Domain,
+        Secure: that.Secure,
+        HttpOnly: that.HttpOnly,
+        SameSite: that.SameSite,
+    }
+    if cookie.Path == "" {
+        cookie.Path = "/"
+    }
+    if that.HostPrefix {
+        cookie.Secure = true
+        cookie.Path = "/"
+        cookie.Domain = ""
+    }
+    return cookie
+}
+
+func (that CookiePolicy) Set(c *gin.Context, name string, value string, maxAge int) {
+    http.SetCookie(c.Writer, that.cookie(name, value, maxAge))
+}
+
+// expire the cookie, with the same path and domain it was set with
+func (that CookiePolicy) Clear(c *gin.Context, name string) {
+    http.SetCookie(c.Writer, that.cookie(name, "", -1))
+}
+
+func (that CookiePolicy) Get(c *gin.Context, name string) (string, error) {
+    return c.Cookie(that.Name(name))
+}
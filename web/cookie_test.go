@@ -0,0 +1,40 @@
+package web
+
+import "testing"
+import "strings"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+
+func Test_CookiePolicy(t *testing.T) {
+    w := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(w)
+    policy := CookiePolicy{Domain: "example.com", Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode}
+    policy.Set(c, "a", "1", 60)
+    policy.Clear(c, "a")
+    cookies := w.Header().Values("Set-Cookie")
+    if len(cookies) != 2 {
+        t.Fatalf("should set 2 cookies: %v", cookies)
+    }
+    for _, cookie := range cookies {
+        for _, attr := range []string{"Path=/", "Domain=example.com", "HttpOnly", "Secure", "SameSite=Strict"} {
+            if !strings.Contains(cookie, attr) {
+                t.Errorf("%s should have %s", cookie, attr)
+            }
+        }
+    }
+    if !strings.Contains(cookies[1], "Max-Age=0") {
+        t.Errorf("cleared cookie should expire: %s", cookies[1])
+    }
+
+    // __Host- prefix
+    w = httptest.NewRecorder()
+    c, _ = gin.CreateTestContext(w)
+    policy = CookiePolicy{Path: "/api", Domain: "example.com", HostPrefix: true}
+    policy.Set(c, "a", "1", 60)
+    cookie := w.Header().Get("Set-Cookie")
+    if !strings.HasPrefix(cookie, "__Host-a=1") || !strings.Contains(cookie, "Path=/;") || strings.Contains(cookie, "Domain") || !strings.Contains(cookie, "Secure") {
+        t.Errorf("wrong __Host- cookie: %s", cookie)
+    }
+}
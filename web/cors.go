@@ -8,17 +8,34 @@ import "github.com/gin-gonic/gin"
 
 const (
     CORS_ALLOW_METHODS string = "GET,HEAD,PUT,PATCH,POST"
-    CORS_ALLOW_HEADERS string = ""
+    CORS_ALLOW_HEADERS string = "Authorization,Content-Type"
 )
 
-func Cors() gin.HandlerFunc {
+// CORS_ALLOW_HEADERS, the api key header, the csrf header of env csrf_header, and extra ones
+func corsAllowHeaders(extra ...string) string {
+    headers := append(strings.Split(CORS_ALLOW_HEADERS, ","), API_KEY_HEADER, csrfHeader())
+    var allowed []string
+    seen := make(map[string]bool)
+    for _, header := range append(headers, extra...) {
+        key := strings.ToLower(header)
+        if header != "" && !seen[key] {
+            seen[key] = true
+            allowed = append(allowed, header)
+        }
+    }
+    return strings.Join(allowed, ",")
+}
+
+// headers: allowed besides the defaults, e.g. a custom Csrf.Header or ApiKey Header
+func Cors(headers ...string) gin.HandlerFunc {
+    allowHeaders := corsAllowHeaders(headers...)
     return func(c *gin.Context) {
         
         method := strings.ToUpper(c.Request.Method)
         if method == "OPTIONS" {
             c.Header("Access-Control-Allow-Origin", "*")
             c.Header("Access-Control-Allow-Methods", CORS_ALLOW_METHODS)
-            c.Header("Access-Control-Allow-Headers", CORS_ALLOW_HEADERS)
+            c.Header("Access-Control-Allow-Headers", allowHeaders)
             c.Status(200)
             c.Abort()
         }else{
@@ -26,4 +43,3 @@ func Cors() gin.HandlerFunc {
         }
     }
 }
-
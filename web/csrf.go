@@ -0,0 +1,257 @@
+// CSRF protection of cookie authenticated requests
+
+package web
+
+import "os"
+import "strings"
+import "net/url"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+
+import "github.com/gin-gonic/gin"
+
+/*
+double submit cookie: a token is set in the cookie CSRF_TOKEN, readable by scripts,
+and unsafe requests (POST, PUT, PATCH, DELETE...) must send it back in the header X-CSRF-Token,
+or the form field csrf_token. other sites can send the cookie, but can't read it.
+
+the token is a random nonce signed with an HMAC over the login session, i.e. the family or the jti
+of the JWT cookies, so a token planted by a sibling subdomain that can set cookies doesn't pass.
+it changes with the session: after login, a safe request gets the new one.
+
+unsafe requests are also checked by Origin, or Referer when Origin is absent:
+the request's own host and the trusted origins pass, other origins respond 403.
+
+requests carrying no auth cookie (JWT_TOKEN, JWT_REFRESH) are not exposed, e.g. Authorization: Bearer
+or X-Api-Key clients, the token is not required of them.
+
+env variables:
+  csrf_header           default: X-CSRF-Token
+  csrf_secret           HMAC key of tokens, default: the JWT secret
+  csrf_trusted_origins  comma separated, e.g. https://app.example.com,https://admin.example.com
+
+usage:
+  r.Use(web.Cors())
+  r.Use(web.CsrfMiddleWare())
+  r.Use(web.Unless("/login").Then(web.JwtMiddleWare()))
+  // in templates
+  c.HTML(200, "form.html", gin.H{"csrf": web.CsrfToken(c)})
+*/
+
+const CSRF_COOKIE_KEY string = "CSRF_TOKEN"
+const CSRF_HEADER string = "X-CSRF-Token"
+const CSRF_FIELD string = "csrf_token"
+const csrfCtxKey = "csrf_token"
+
+type Csrf struct {
+    Header string  // default: env csrf_header, or X-CSRF-Token
+    Field string  // form field, default: csrf_token
+    TrustedOrigins []string  // scheme://host[:port] allowed besides the request's own host. default: env csrf_trusted_origins
+    AuthCookies []string  // unsafe requests carrying none of them skip the token check. default: the JWT cookies
+    Cookie *CookiePolicy  // default: the policy of the JWT cookies, readable by scripts
+    Jwt *Jwt  // verifies the JWT cookies that tokens are bound to. default: the default Jwt
+    Secret string  // HMAC key of tokens, default: env csrf_secret, or the secret of Jwt
+}
+
+// the configured header name, env csrf_header or X-CSRF-Token
+func csrfHeader() string {
+    if header := os.Getenv("csrf_header"); header != "" {
+        return header
+    }
+    return CSRF_HEADER
+}
+
+func (obj *Csrf) Init() {
+    if obj.Header == "" {
+        obj.Header = csrfHeader()
+    }
+    if obj.Field == "" {
+        obj.Field = CSRF_FIELD
+    }
+    if obj.TrustedOrigins == nil {
+        for _, origin := range strings.Split(os.Getenv("csrf_trusted_origins"), ",") {
+            if origin = strings.TrimSpace(origin); origin != "" {
+                obj.TrustedOrigins = append(obj.TrustedOrigins, strings.TrimRight(origin, "/"))
+            }
+        }
+    }
+    if obj.Jwt == nil {
+        obj.Jwt = getInstance()
+    }
+    if obj.Secret == "" {
+        obj.Secret = os.Getenv("csrf_secret")
+    }
+    if obj.Secret == "" {
+        obj.Secret = obj.Jwt.Secret
+    }
+    if obj.Cookie == nil {
+        // same path, domain and prefix as the JWT cookies
+        policy := *obj.Jwt.Cookie
+        policy.HttpOnly = false
+        obj.Cookie = &policy
+    }
+    if obj.AuthCookies == nil {
+        obj.AuthCookies = []string{obj.Cookie.Name(JWT_COOKIE_KEY), obj.Cookie.Name(JWT_REFRESH_COOKIE_KEY)}
+    }
+}
+
+// middleware with env settings
+func CsrfMiddleWare() gin.HandlerFunc {
+    obj := new(Csrf)
+    obj.Init()
+    return obj.Ware
+}
+
+func csrfSafe(method string) bool {
+    switch strings.ToUpper(method) {
+    case "GET", "HEAD", "OPTIONS", "TRACE":
+        return true
+    }
+    return false
+}
+
+// the session of the JWT cookies: the family of the token, or its jti. "" when none is valid
+func (obj *Csrf) session(c *gin.Context) string {
+    for _, key := range []string{JWT_COOKIE_KEY, JWT_REFRESH_COOKIE_KEY} {
+        token, _ := obj.Jwt.Cookie.Get(c, key)
+        if token == "" {
+            continue
+        }
+        if claims, err := obj.Jwt.validate(token); err == nil {
+            if claims.Family != "" {
+                return claims.Family
+            }
+            return claims.Id
+        }
+    }
+    return ""
+}
+
+// hex of the nonce and its HMAC over the session, 64 chars
+func (obj *Csrf) sign(nonce []byte, session string) string {
+    mac := hmac.New(sha256.New, []byte(obj.Secret))
+    mac.Write(nonce)
+    mac.Write([]byte(session))
+    return hex.EncodeToString(nonce) + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (obj *Csrf) newToken(session string) string {
+    nonce := make([]byte, 16)
+    rand.Read(nonce)
+    return obj.sign(nonce, session)
+}
+
+// whether the token was signed for the session
+func (obj *Csrf) verify(token string, session string) bool {
+    if len(token) != 64 {
+        return false
+    }
+    nonce, err := hex.DecodeString(token[:32])
+    if err != nil {
+        return false
+    }
+    return hmac.Equal([]byte(token), []byte(obj.sign(nonce, session)))
+}
+
+// the token of the cookie, or a new one set in the cookie when it is not of the current session
+func (obj *Csrf) token(c *gin.Context) string {
+    if v, ok := c.Get(csrfCtxKey); ok {
+        return v.(string)
+    }
+    session := obj.session(c)
+    token, _ := obj.Cookie.Get(c, CSRF_COOKIE_KEY)
+    if !obj.verify(token, session) {
+        token = obj.newToken(session)
+        // a session cookie
+        obj.Cookie.Set(c, CSRF_COOKIE_KEY, token, 0)
+    }
+    c.Set(csrfCtxKey, token)
+    return token
+}
+
+func requestOrigin(c *gin.Context) string {
+    scheme := "http"
+    if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+        scheme = "https"
+    }
+    return scheme + "://" + c.Request.Host
+}
+
+func (obj *Csrf) trusted(c *gin.Context, origin string) bool {
+    origin = strings.TrimRight(origin, "/")
+    if strings.EqualFold(origin, requestOrigin(c)) {
+        return true
+    }
+    for _, item := range obj.TrustedOrigins {
+        if strings.EqualFold(origin, item) {
+            return true
+        }
+    }
+    return false
+}
+
+// Origin, or the origin of Referer. "" when both are absent
+func sourceOrigin(c *gin.Context) string {
+    if origin := c.GetHeader("Origin"); origin != "" {
+        return origin
+    }
+    if referer := c.GetHeader("Referer"); referer != "" {
+        u, err := url.Parse(referer)
+        if err != nil || u.Host == "" {
+            // unparsable referers are not trusted
+            return "null"
+        }
+        return u.Scheme + "://" + u.Host
+    }
+    return ""
+}
+
+func (obj *Csrf) authenticated(c *gin.Context) bool {
+    for _, name := range obj.AuthCookies {
+        if cookie, err := c.Cookie(name); err == nil && cookie != "" {
+            return true
+        }
+    }
+    return false
+}
+
+// middleware. 403 for an untrusted origin, or a missing, wrong or unsigned token
+func (obj *Csrf) Ware(c *gin.Context) {
+    if csrfSafe(c.Request.Method) {
+        obj.token(c)
+        c.Next()
+        return
+    }
+    if origin := sourceOrigin(c); origin != "" && !obj.trusted(c, origin) {
+        log.Warnf("csrf: untrusted origin %s", origin)
+        Forbidden(c, nil)
+        return
+    }
+    if !obj.authenticated(c) {
+        c.Next()
+        return
+    }
+    expected, _ := obj.Cookie.Get(c, CSRF_COOKIE_KEY)
+    sent := c.GetHeader(obj.Header)
+    if sent == "" {
+        sent = c.PostForm(obj.Field)
+    }
+    if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(sent)) != 1 || !obj.verify(sent, obj.session(c)) {
+        Forbidden(c, nil)
+        return
+    }
+    c.Next()
+}
+
+// the token to render into forms, or to send back by scripts. it sets the cookie when needed
+func CsrfToken(c *gin.Context) string {
+    if v, ok := c.Get(csrfCtxKey); ok {
+        return v.(string)
+    }
+    obj := new(Csrf)
+    obj.Init()
+    return obj.token(c)
+}
@@ -0,0 +1,144 @@
+package web
+
+import "testing"
+import "strings"
+import "context"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+
+func Test_Csrf(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    obj := &Csrf{TrustedOrigins: []string{"https://app.example.com"}, Cookie: &CookiePolicy{}}
+    obj.Init()
+    r := gin.New()
+    r.Use(obj.Ware)
+    r.GET("/form", func(c *gin.Context) { c.String(200, CsrfToken(c)) })
+    r.POST("/posts", func(c *gin.Context) { c.String(200, "ok") })
+
+    // a safe request gets the token
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest("GET", "/form", nil))
+    token := w.Body.String()
+    if len(token) != 64 || !strings.Contains(w.Header().Get("Set-Cookie"), CSRF_COOKIE_KEY + "=" + token) {
+        t.Fatalf("should set the token cookie: %s %s", token, w.Header().Get("Set-Cookie"))
+    }
+
+    post := func(header string, origin string, withJwt bool) int {
+        req := httptest.NewRequest("POST", "http://api.example.com/posts", nil)
+        req.AddCookie(&http.Cookie{Name: CSRF_COOKIE_KEY, Value: token})
+        if withJwt {
+            req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: "jwt"})
+        }
+        if header != "" {
+            req.Header.Set(CSRF_HEADER, header)
+        }
+        if origin != "" {
+            req.Header.Set("Origin", origin)
+        }
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+    cases := []struct {
+        header string
+        origin string
+        withJwt bool
+        code int
+    }{
+        {token, "", true, 200},
+        {token, "https://app.example.com", true, 200},
+        {token, "http://api.example.com", true, 200},
+        {token, "https://evil.example.com", true, 403},
+        {"", "", true, 403},
+        {strings.Repeat("0", 64), "", true, 403},
+        // not cookie authenticated
+        {"", "", false, 200},
+        {"", "https://evil.example.com", false, 403},
+    }
+    for i, item := range cases {
+        if code := post(item.header, item.origin, item.withJwt); code != item.code {
+            t.Errorf("case %d: should respond %d, got %d", i, item.code, code)
+        }
+    }
+
+    // form field and referer
+    req := httptest.NewRequest("POST", "http://api.example.com/posts", strings.NewReader(CSRF_FIELD + "=" + token))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Referer", "https://app.example.com/posts/new")
+    req.AddCookie(&http.Cookie{Name: CSRF_COOKIE_KEY, Value: token})
+    req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: "jwt"})
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    if w.Code != 200 {
+        t.Errorf("form field should pass, got %d", w.Code)
+    }
+}
+
+func Test_CsrfSession(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    api := &Jwt{Secret: "csrf", Cookie: &CookiePolicy{}}
+    api.Init()
+    obj := &Csrf{Jwt: api}
+    obj.Init()
+    r := gin.New()
+    r.Use(obj.Ware)
+    r.GET("/form", func(c *gin.Context) { c.String(200, CsrfToken(c)) })
+    r.POST("/posts", func(c *gin.Context) { c.String(200, "ok") })
+    alice, _ := api.Issue(context.Background(), "alice")
+    bob, _ := api.Issue(context.Background(), "bob")
+
+    tokenOf := func(jwtToken string) string {
+        req := httptest.NewRequest("GET", "/form", nil)
+        req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: jwtToken})
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Body.String()
+    }
+    post := func(jwtToken string, token string) int {
+        req := httptest.NewRequest("POST", "/posts", nil)
+        req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: jwtToken})
+        req.AddCookie(&http.Cookie{Name: CSRF_COOKIE_KEY, Value: token})
+        req.Header.Set(CSRF_HEADER, token)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+    aliceToken := tokenOf(alice)
+    if code := post(alice, aliceToken); code != 200 {
+        t.Errorf("token of the session should pass, got %d", code)
+    }
+    // planted by a sibling subdomain: its own random token, or a token of another session
+    if code := post(alice, strings.Repeat("ab", 32)); code != 403 {
+        t.Errorf("unsigned token should respond 403, got %d", code)
+    }
+    if code := post(alice, tokenOf(bob)); code != 403 {
+        t.Errorf("token of another session should respond 403, got %d", code)
+    }
+    if code := post(alice, tokenOf("")); code != 403 {
+        t.Errorf("anonymous token should respond 403 once logged in, got %d", code)
+    }
+    // a safe request replaces a token of another session
+    req := httptest.NewRequest("GET", "/form", nil)
+    req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: alice})
+    req.AddCookie(&http.Cookie{Name: CSRF_COOKIE_KEY, Value: tokenOf(bob)})
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    if renewed := w.Body.String(); !strings.Contains(w.Header().Get("Set-Cookie"), renewed) || post(alice, renewed) != 200 {
+        t.Errorf("should set a token of the session: %s", w.Header().Get("Set-Cookie"))
+    }
+}
+
+func Test_Cors(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    t.Setenv("csrf_header", "X-XSRF-Token")
+    r := gin.New()
+    r.Use(Cors("X-Token", "authorization"))
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/posts", nil))
+    allowed := w.Header().Get("Access-Control-Allow-Headers")
+    if allowed != "Authorization,Content-Type,X-Api-Key,X-XSRF-Token,X-Token" {
+        t.Errorf("wrong allowed headers: %s", allowed)
+    }
+}
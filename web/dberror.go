@@ -0,0 +1,65 @@
+// map storage errors into responses
+
+package web
+
+import "github.com/gin-gonic/gin"
+import "github.com/jackielihf/golib/storage"
+
+/*
+usage:
+
+r.Use(web.DbErrors())
+
+func handler(c *gin.Context) {
+    if err := db.Insert("users", fields, "", nil); err != nil {
+        c.Error(err)  // 409 on a unique violation
+        return
+    }
+    ...
+}
+*/
+
+// status code of an error from storage
+func DbErrorStatus(err error) int {
+    switch {
+    case storage.IsNotFound(err):
+        return 404
+    case storage.IsUniqueViolation(err):
+        return 409
+    case storage.IsInvalidInput(err):
+        return 400
+    case storage.IsTimeout(err):
+        return 504
+    case storage.IsRetryable(err):
+        return 503
+    }
+    return 500
+}
+
+// respond an error from storage: 404 not found, 409 unique violation, 400 invalid input,
+// 504 timeout, 503 retryable, otherwise 500
+func DbError(c *gin.Context, err error) {
+    statusCode := DbErrorStatus(err)
+    data := gin.H{
+        "code": statusCode,
+        "msg": StatusCode[statusCode],
+    }
+    if constraint := storage.ConstraintName(err); constraint != "" && statusCode < 500 {
+        data["constraint"] = constraint
+    }
+    if statusCode >= 500 {
+        log.Errorf("db error: %v", err)
+    }
+    respondError(c, statusCode, data)
+}
+
+// middleware. respond the last error attached by c.Error, if nothing was written
+func DbErrors() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Next()
+        if c.Writer.Written() || len(c.Errors) == 0 {
+            return
+        }
+        DbError(c, c.Errors.Last().Err)
+    }
+}
@@ -0,0 +1,66 @@
+package web
+
+import "testing"
+import "errors"
+import "strings"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+import "github.com/lib/pq"
+import "github.com/jackielihf/golib/storage"
+
+func Test_DbErrorStatus(t *testing.T) {
+    cases := map[string]struct {
+        err error
+        status int
+    }{
+        "not found": {storage.ErrNotFound, 404},
+        "unique": {&pq.Error{Code: storage.CodeUniqueViolation}, 409},
+        "foreign key": {&pq.Error{Code: storage.CodeForeignKeyViolation}, 400},
+        "not null": {&pq.Error{Code: storage.CodeNotNullViolation}, 400},
+        "timeout": {storage.ErrQueryTimeout, 504},
+        "deadlock": {&pq.Error{Code: storage.CodeDeadlockDetected}, 503},
+        "syntax": {&pq.Error{Code: "42601"}, 500},
+        "other": {errors.New("boom"), 500},
+    }
+    for name, c := range cases {
+        if status := DbErrorStatus(c.err); status != c.status {
+            t.Errorf("%s: expected %d, got %d", name, c.status, status)
+        }
+    }
+}
+
+func Test_DbErrors(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.Use(DbErrors())
+    r.GET("/unique", func(c *gin.Context) {
+        c.Error(&pq.Error{Code: storage.CodeUniqueViolation, Constraint: "users_email_key"})
+    })
+    r.GET("/internal", func(c *gin.Context) {
+        c.Error(&pq.Error{Code: "42601", Constraint: "secret_constraint"})
+    })
+    r.GET("/written", func(c *gin.Context) {
+        c.Error(storage.ErrNotFound)
+        c.String(200, "ok")
+    })
+    r.GET("/none", func(c *gin.Context) {})
+    get := func(path string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+        return w
+    }
+
+    if w := get("/unique"); w.Code != 409 || !strings.Contains(w.Body.String(), `"constraint":"users_email_key"`) {
+        t.Errorf("unique violation should respond 409 with the constraint: %d %s", w.Code, w.Body.String())
+    }
+    if w := get("/internal"); w.Code != 500 || strings.Contains(w.Body.String(), "secret_constraint") {
+        t.Errorf("internal errors should respond 500 without details: %d %s", w.Code, w.Body.String())
+    }
+    if w := get("/written"); w.Code != 200 || w.Body.String() != "ok" {
+        t.Errorf("a written response should be kept: %d %s", w.Code, w.Body.String())
+    }
+    if w := get("/none"); w.Code != 200 {
+        t.Errorf("no error should pass, got %d", w.Code)
+    }
+}
@@ -0,0 +1,46 @@
+// health check endpoint
+
+package web
+
+import "time"
+import "github.com/gin-gonic/gin"
+import "github.com/jackielihf/golib/storage"
+
+/*
+usage:
+
+r.GET("/health", web.PgHealth(map[string]*storage.PgClient{"db": client}))
+*/
+
+// respond 200 when all clients are available, otherwise 503.
+// the endpoint is public, so errors are logged but not responded: they carry hosts and user names
+func PgHealth(clients map[string]*storage.PgClient) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        available := true
+        nodes := gin.H{}
+        for name, client := range clients {
+            health := client.Health()
+            node := gin.H{
+                "available": health.Available,
+                "latency_ms": float64(health.Latency) / float64(time.Millisecond),
+                "consecutive_failures": health.ConsecutiveFailures,
+            }
+            if !health.LastSuccess.IsZero() {
+                node["last_success"] = health.LastSuccess
+            }
+            if health.LastError != "" {
+                node["last_error_at"] = health.LastErrorAt
+                if !health.Available {
+                    log.Warnf("health: %s unavailable: %s", name, health.LastError)
+                }
+            }
+            nodes[name] = node
+            available = available && health.Available
+        }
+        if !available {
+            ServiceUnavailable(c, gin.H{"status": "unavailable", "db": nodes})
+            return
+        }
+        Success(c, gin.H{"status": "ok", "db": nodes})
+    }
+}
@@ -8,6 +8,7 @@ import "strconv"
 import "errors"
 import "sync"
 import "encoding/json"
+import "context"
 
 import "github.com/gin-gonic/gin"
 import "github.com/dgrijalva/jwt-go"
@@ -15,7 +16,9 @@ import "github.com/google/uuid"
 
 // cookie key name
 const JWT_COOKIE_KEY string = "JWT_TOKEN"
-const JWT_OBJ_KEY string = "user_ctx"
+const JWT_OBJ_KEY string = "user_ctx"  // no longer set, stripped from requests
+// claims key of gin.Context
+const JWT_CLAIMS_KEY string = "jwt_claims"
 // singleton
 var instance *Jwt
 var once sync.Once
@@ -33,43 +36,58 @@ func JwtMiddleWare() gin.HandlerFunc{
     return getInstance().Ware
 }
 
+// consult a session store, so that tokens can be revoked before they expire
+func JwtUseSessions(store SessionStore) {
+    getInstance().Sessions = store
+}
+
 // sign and set cookie
 func JwtSetCookie(c *gin.Context, v interface{}) {
-    if bytes, err := json.Marshal(v); err == nil {
-        payload := string(bytes)
-        if payload != "" {
-            obj := getInstance()
-            if token, err := obj.sign(payload); err == nil {
-                c.SetCookie(JWT_COOKIE_KEY, token, obj.Expire, "", obj.Domain, false, false)            
-            } 
-        }
-    }
+    getInstance().SetCookie(c, v)
 }
 
-// clear cookie
+// sign a token for Authorization: Bearer clients
+func JwtIssue(c *gin.Context, v interface{}) (string, error) {
+    return getInstance().Issue(c.Request.Context(), v)
+}
+
+// clear cookie, and revoke its session
 func JwtClearCookie(c *gin.Context) {
-    c.SetCookie(JWT_COOKIE_KEY, "", 0, "", "", false, false)    
+    getInstance().ClearCookie(c)
 }
 
-// read string from cookie, and parse it for user context which stored in v
+// parse the payload of the request's token into v
 func JwtUserCtx(c *gin.Context, v interface{}) error {
-    //read string
-    if jsonString := c.Request.Header.Get(JWT_OBJ_KEY); jsonString != "" {
-        if err := json.Unmarshal([]byte(jsonString), v); err != nil {
-            return err
-        }
-    }else{
-        return errors.New(JWT_OBJ_KEY + " not exists")    
+    claims, ok := JwtRawClaims(c)
+    if !ok || claims.Payload == "" {
+        return errors.New(JWT_CLAIMS_KEY + " not exists")    
     }
-    return nil
+    return json.Unmarshal([]byte(claims.Payload), v)
 }
 
 
+// sessions of issued tokens, keyed by jti. e.g. storage.PgSessionStore
+type SessionStore interface {
+    Create(ctx context.Context, jti string, expiresAt time.Time) error
+    Active(ctx context.Context, jti string) (bool, error)
+    // true when this call revoked an active session. atomic, of concurrent calls only one gets true
+    Revoke(ctx context.Context, jti string) (bool, error)
+}
+
 // Jwt 
 type Jwt struct {
     Secret string
     Domain string
     Expire int
+    Sessions SessionStore  // optional. tokens without an active session are rejected
+    Sources []TokenSource  // tried in order, default: env jwt_sources, or bearer then cookie
+    Keys []*JwtKey  // the first key with a private key signs, all of them verify. default: env jwt_alg etc., or HS256 with Secret
+    RefreshExpire int  // seconds, lifetime of a refresh token family. default: env jwt_refresh_expire, or 30 days
+    RenewBefore int  // seconds, re-issue access tokens of a family this close to expiry. default: env jwt_renew_before, or Expire / 4
+    Issuer string  // iss of issued tokens, and required of verified ones. default: env jwt_issuer
+    Audience string  // aud of issued tokens, and required of verified ones. default: env jwt_audience
+    ClockSkew int  // seconds tolerated when checking exp, nbf and iat. default: env jwt_clock_skew, or 0
+    Cookie *CookiePolicy  // default: env cookie_*, Domain defaults to the Domain above
     secretBytes []byte
 }
 
@@ -93,15 +111,172 @@ func (obj *Jwt) Init() {
     if obj.Expire < 1 {
         obj.Expire = 60 * 60 * 24  // 1 day   
     }
+    //refresh
+    if obj.RefreshExpire < 1 {
+        obj.RefreshExpire, _ = strconv.Atoi(os.Getenv("jwt_refresh_expire"))
+    }
+    if obj.RefreshExpire < 1 {
+        obj.RefreshExpire = 60 * 60 * 24 * 30  // 30 days
+    }
+    if obj.RenewBefore < 1 {
+        obj.RenewBefore, _ = strconv.Atoi(os.Getenv("jwt_renew_before"))
+    }
+    if obj.RenewBefore < 1 {
+        obj.RenewBefore = obj.Expire / 4
+    }
+    //standard claims
+    if obj.Issuer == "" {
+        obj.Issuer = os.Getenv("jwt_issuer")
+    }
+    if obj.Audience == "" {
+        obj.Audience = os.Getenv("jwt_audience")
+    }
+    if obj.ClockSkew < 1 {
+        obj.ClockSkew, _ = strconv.Atoi(os.Getenv("jwt_clock_skew"))
+    }
+    //cookie
+    if obj.Cookie == nil {
+        policy := CookiePolicyFromEnv()
+        obj.Cookie = &policy
+    }
+    if obj.Cookie.Domain == "" {
+        obj.Cookie.Domain = obj.Domain
+    }
+    //sources
+    if len(obj.Sources) == 0 {
+        obj.Sources = defaultTokenSources(obj.Cookie.Name(JWT_COOKIE_KEY))
+    }
+    //keys
+    var err error
+    if len(obj.Keys) == 0 {
+        err = obj.loadKeys()
+    }
+    for _, key := range obj.Keys {
+        if err == nil {
+            err = key.init()
+        }
+    }
+    if err != nil {
+        // fail closed: nothing can be signed or verified
+        log.Errorf("jwt keys: %v", err)
+        obj.Keys = nil
+    }
+}
+
+// sign v, and create its session
+func (obj *Jwt) Issue(ctx context.Context, v interface{}) (string, error) {
+    payload, err := jsonString(v)
+    if err != nil {
+        return "", err
+    }
+    return obj.issue(ctx, obj.newClaims(payload, subjectOf(v), "", "", obj.Expire))
+}
+
+// v provides the sub claim by implementing it
+type JwtSubject interface {
+    JwtSubject() string
+}
+
+func subjectOf(v interface{}) string {
+    if subject, ok := v.(JwtSubject); ok {
+        return subject.JwtSubject()
+    }
+    return ""
+}
+
+func jsonString(v interface{}) (string, error) {
+    bytes, err := json.Marshal(v)
+    return string(bytes), err
+}
+
+// sign claims, and create the session
+func (obj *Jwt) issue(ctx context.Context, claims *MyClaims) (string, error) {
+    token, err := obj.signClaims(claims)
+    if err != nil {
+        return "", err
+    }
+    if obj.Sessions != nil {
+        if err = obj.Sessions.Create(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+            return "", err
+        }
+    }
+    return token, nil
+}
+
+// sign and set cookie
+func (obj *Jwt) SetCookie(c *gin.Context, v interface{}) {
+    if token, err := obj.Issue(c.Request.Context(), v); err == nil {
+        obj.Cookie.Set(c, JWT_COOKIE_KEY, token, obj.Expire)
+    }else{
+        log.Errorf("jwt: %v", err)
+    }
+}
+
+// clear cookies, and revoke the sessions of the request's tokens and their family
+func (obj *Jwt) ClearCookie(c *gin.Context) {
+    if obj.Sessions != nil {
+        refreshToken, _ := obj.Cookie.Get(c, JWT_REFRESH_COOKIE_KEY)
+        for _, token := range []string{obj.extract(c), refreshToken} {
+            if token == "" {
+                continue
+            }
+            if claims, err := obj.validate(token); err == nil {
+                for _, jti := range []string{claims.Id, claims.Family} {
+                    if jti == "" {
+                        continue
+                    }
+                    if _, err2 := obj.Sessions.Revoke(c.Request.Context(), jti); err2 != nil {
+                        log.Errorf("jwt session: %v", err2)
+                    }
+                }
+            }
+        }
+    }
+    obj.Cookie.Clear(c, JWT_COOKIE_KEY)
+    obj.Cookie.Clear(c, JWT_REFRESH_COOKIE_KEY)
+}
+
+// whether the sessions of the token and its family are active
+func (obj *Jwt) active(ctx context.Context, claims *MyClaims) (bool, error) {
+    if obj.Sessions == nil {
+        return true, nil
+    }
+    if claims.Id == "" {
+        return false, nil
+    }
+    for _, jti := range []string{claims.Id, claims.Family} {
+        if jti == "" {
+            continue
+        }
+        if active, err := obj.Sessions.Active(ctx, jti); err != nil || !active {
+            return false, err
+        }
+    }
+    return true, nil
 }
 
 // middleware. parse and validate the JWT token
 func (obj *Jwt) Ware(c *gin.Context) {
+    // a forged user context
+    c.Request.Header.Del(JWT_OBJ_KEY)
     // get token
-    if token, err := c.Cookie(JWT_COOKIE_KEY); err == nil && token != "" {
-        if jsonString, err := obj.validate(token); err == nil {
-            // jwt token stored in request's header
-            c.Request.Header.Set(JWT_OBJ_KEY, jsonString)
+    if token := obj.extract(c); token != "" {
+        // refresh tokens are only accepted by the refresh handler
+        if claims, err := obj.validate(token); err == nil && claims.Type == "" {
+            active, err2 := obj.active(c.Request.Context(), claims)
+            if err2 != nil {
+                log.Errorf("jwt session: %v", err2)
+                ServiceUnavailable(c, nil)
+                return
+            }
+            if !active {
+                c.JSON(401, gin.H{"message": "invalid token"})
+                c.Abort()
+                return
+            }
+            obj.renew(c, claims)
+            // claims stored in the context, see JwtClaims
+            c.Set(JWT_CLAIMS_KEY, claims)
             c.Next()    
             return
         }                
@@ -115,43 +290,78 @@ func (obj *Jwt) Ware(c *gin.Context) {
 // custom claim
 type MyClaims struct {
     Payload string `json:"payload"`
+    Type string `json:"typ,omitempty"`  // "refresh" for refresh tokens
+    Family string `json:"fam,omitempty"`  // session of the access/refresh token family
     jwt.StandardClaims
 }
 
-// encode payload
-func (obj *Jwt) sign(payload string) (string, error){    
-    // Create the Claims
-    claims := MyClaims{
+func (obj *Jwt) newClaims(payload string, subject string, typ string, family string, expire int) *MyClaims {
+    now := time.Now().Unix()
+    return &MyClaims{
         payload,
+        typ,
+        family,
         jwt.StandardClaims{
-            ExpiresAt: time.Now().Unix() + int64(obj.Expire),
+            Id: uuid.New().String(),
+            Subject: subject,
+            Issuer: obj.Issuer,
+            Audience: obj.Audience,
+            IssuedAt: now,
+            NotBefore: now,
+            ExpiresAt: now + int64(expire),
         },
     }
+}
+
+func (obj *Jwt) signClaims(claims *MyClaims) (string, error){    
+    key := obj.signingKey()
+    if key == nil {
+        return "", errors.New("jwt: no signing key")
+    }
     // get token
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    ss, err := token.SignedString(obj.secretBytes)
-    return ss, err
+    token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+    if key.Kid != "" {
+        token.Header["kid"] = key.Kid
+    }
+    return token.SignedString(key.Key)
 }
 
 
 // decode token
-func (obj *Jwt) validate(tokenString string) (string, error){  
+func (obj *Jwt) validate(tokenString string) (*MyClaims, error){  
     // parse
-    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-        return obj.secretBytes, nil
-    })
+    parser := jwt.Parser{SkipClaimsValidation: true}
+    token, err := parser.ParseWithClaims(tokenString, &MyClaims{}, obj.keyFunc)
     // validate
-    if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-        if payload, ok := claims["payload"].(string); ok {
-            return payload, nil
-        }else{
-            return "", errors.New("payload mismatch string type")
-        }
+    if err != nil {
+        return nil, err
+    }
+    if claims, ok := token.Claims.(*MyClaims); ok && token.Valid {
+        return claims, obj.checkClaims(claims)
     } else {
-        return "", err
+        return nil, errors.New("invalid token")
     }
 }
 
+// check standard claims with the clock skew
+func (obj *Jwt) checkClaims(claims *MyClaims) error {
+    now := time.Now().Unix()
+    skew := int64(obj.ClockSkew)
+    switch {
+    case claims.ExpiresAt == 0 || now > claims.ExpiresAt + skew:
+        return errors.New("jwt: token is expired")
+    case claims.NotBefore > now + skew:
+        return errors.New("jwt: token is not valid yet")
+    case claims.IssuedAt > now + skew:
+        return errors.New("jwt: token used before issued")
+    case obj.Issuer != "" && claims.Issuer != obj.Issuer:
+        return errors.New("jwt: wrong issuer")
+    case obj.Audience != "" && claims.Audience != obj.Audience:
+        return errors.New("jwt: wrong audience")
+    }
+    return nil
+}
+
 
 
 
@@ -0,0 +1,74 @@
+// typed claims of the request's token
+
+package web
+
+import "time"
+import "errors"
+import "encoding/json"
+
+import "github.com/gin-gonic/gin"
+
+/*
+usage:
+
+type User struct {
+    Id string `json:"id"`
+    Name string `json:"name"`
+}
+func (u User) JwtSubject() string { return u.Id }  // optional, becomes the sub claim
+
+web.JwtSetCookie(c, User{"1", "jack"})
+...
+claims, err := web.JwtClaims[User](c)
+claims.Data.Name, claims.Subject, claims.ExpiresAt
+*/
+
+type Claims[T any] struct {
+    Data T
+    Id string
+    Subject string
+    Issuer string
+    Audience string
+    IssuedAt time.Time
+    NotBefore time.Time
+    ExpiresAt time.Time
+}
+
+// claims stored by the middleware
+func JwtRawClaims(c *gin.Context) (*MyClaims, bool) {
+    if v, ok := c.Get(JWT_CLAIMS_KEY); ok {
+        claims, ok := v.(*MyClaims)
+        return claims, ok
+    }
+    return nil, false
+}
+
+// claims of the request's token, with the payload decoded into T
+func JwtClaims[T any](c *gin.Context) (*Claims[T], error) {
+    raw, ok := JwtRawClaims(c)
+    if !ok {
+        return nil, errors.New(JWT_CLAIMS_KEY + " not exists")
+    }
+    claims := &Claims[T]{
+        Id: raw.Id,
+        Subject: raw.Subject,
+        Issuer: raw.Issuer,
+        Audience: raw.Audience,
+        IssuedAt: unixTime(raw.IssuedAt),
+        NotBefore: unixTime(raw.NotBefore),
+        ExpiresAt: unixTime(raw.ExpiresAt),
+    }
+    if raw.Payload != "" {
+        if err := json.Unmarshal([]byte(raw.Payload), &claims.Data); err != nil {
+            return nil, err
+        }
+    }
+    return claims, nil
+}
+
+func unixTime(sec int64) time.Time {
+    if sec == 0 {
+        return time.Time{}
+    }
+    return time.Unix(sec, 0)
+}
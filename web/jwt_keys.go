@@ -0,0 +1,312 @@
+// signing and verification keys of JWT
+
+package web
+
+import "os"
+import "fmt"
+import "errors"
+import "strings"
+import "io/ioutil"
+import "math/big"
+import "crypto"
+import "crypto/rsa"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+import "crypto/elliptic"
+import "crypto/x509"
+import "encoding/pem"
+import "encoding/base64"
+
+import "github.com/gin-gonic/gin"
+import "github.com/dgrijalva/jwt-go"
+
+/*
+keys are identified by kid. the signing key puts its kid into the token header,
+and tokens are verified by the key of their kid, so old keys can stay for verification during rotation.
+
+env variables:
+  jwt_alg           HS256(default), HS384, HS512, RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512, EdDSA
+  jwt_kid           kid of the signing key
+  jwt_private_key   PEM file of the signing key. HS* use jwt_secret instead
+  jwt_verify_keys   extra verification keys, comma separated kid=file, e.g. "2023=/keys/old.pem"
+
+usage:
+  key, err := web.LoadJwtKey("2024", "RS256", "/keys/private.pem")
+  api := &web.Jwt{Keys: []*web.JwtKey{key}}
+  api.Init()
+  r.GET("/.well-known/jwks.json", api.JWKS)
+*/
+
+var errJwtAlg = errors.New("jwt: unexpected signing method")
+
+// EdDSA (Ed25519), not provided by jwt-go v3
+type signingMethodEdDSA struct{}
+
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+    jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+        return SigningMethodEdDSA
+    })
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+    return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+    publicKey, ok := key.(ed25519.PublicKey)
+    if !ok {
+        return jwt.ErrInvalidKeyType
+    }
+    sig, err := jwt.DecodeSegment(signature)
+    if err != nil {
+        return err
+    }
+    if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+        return jwt.ErrSignatureInvalid
+    }
+    return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+    privateKey, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return "", jwt.ErrInvalidKeyType
+    }
+    return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+type JwtKey struct {
+    Kid string
+    Alg string
+    Key interface{}  // signing key: []byte(HS*), *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey. nil: verification only
+    PublicKey interface{}  // verification key of asymmetric algorithms, derived from Key when nil
+}
+
+// check the algorithm against the key types, and derive the public key
+func (key *JwtKey) init() error {
+    if key.Alg == "none" || jwt.GetSigningMethod(key.Alg) == nil {
+        return fmt.Errorf("jwt: unknown alg %s", key.Alg)
+    }
+    if key.PublicKey == nil {
+        if signer, ok := key.Key.(crypto.Signer); ok {
+            key.PublicKey = signer.Public()
+        }
+    }
+    switch key.Alg[:2] {
+    case "HS":
+        if secret, ok := key.Key.([]byte); !ok || len(secret) == 0 {
+            return fmt.Errorf("jwt: %s needs a secret", key.Alg)
+        }
+        return nil
+    case "RS", "PS":
+        _, ok := key.PublicKey.(*rsa.PublicKey)
+        return checkKeyType(key, ok)
+    case "ES":
+        publicKey, ok := key.PublicKey.(*ecdsa.PublicKey)
+        if ok && publicKey.Curve.Params().BitSize != map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[key.Alg] {
+            return fmt.Errorf("jwt: wrong curve %s for %s", publicKey.Curve.Params().Name, key.Alg)
+        }
+        return checkKeyType(key, ok)
+    }
+    _, ok := key.PublicKey.(ed25519.PublicKey)
+    return checkKeyType(key, ok)
+}
+
+func checkKeyType(key *JwtKey, ok bool) error {
+    if !ok {
+        return fmt.Errorf("jwt: wrong key type %T for %s", key.PublicKey, key.Alg)
+    }
+    return nil
+}
+
+func (key *JwtKey) verifyKey() interface{} {
+    if key.PublicKey != nil {
+        return key.PublicKey
+    }
+    return key.Key
+}
+
+// load a PEM file. a private key can sign, a public key or certificate only verifies.
+// alg "": inferred from the key type
+func LoadJwtKey(kid string, alg string, file string) (*JwtKey, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    return ParseJwtKey(kid, alg, data)
+}
+
+func ParseJwtKey(kid string, alg string, data []byte) (*JwtKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("jwt: no PEM block")
+    }
+    key := &JwtKey{Kid: kid, Alg: alg}
+    var err error
+    switch block.Type {
+    case "PRIVATE KEY":
+        key.Key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PRIVATE KEY":
+        key.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "EC PRIVATE KEY":
+        key.Key, err = x509.ParseECPrivateKey(block.Bytes)
+    case "PUBLIC KEY":
+        key.PublicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+    case "RSA PUBLIC KEY":
+        key.PublicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+    case "CERTIFICATE":
+        var cert *x509.Certificate
+        if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+            key.PublicKey = cert.PublicKey
+        }
+    default:
+        return nil, fmt.Errorf("jwt: unsupported PEM type %s", block.Type)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if key.Alg == "" {
+        key.Alg = inferAlg(key)
+    }
+    if err = key.init(); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func inferAlg(key *JwtKey) string {
+    publicKey := key.PublicKey
+    if signer, ok := key.Key.(crypto.Signer); ok {
+        publicKey = signer.Public()
+    }
+    switch k := publicKey.(type) {
+    case *rsa.PublicKey:
+        return "RS256"
+    case *ecdsa.PublicKey:
+        switch k.Curve {
+        case elliptic.P384():
+            return "ES384"
+        case elliptic.P521():
+            return "ES512"
+        }
+        return "ES256"
+    case ed25519.PublicKey:
+        return "EdDSA"
+    }
+    return ""
+}
+
+// keys of env variables, or HS256 with the secret
+func (obj *Jwt) loadKeys() error {
+    alg := os.Getenv("jwt_alg")
+    if alg == "" {
+        alg = "HS256"
+    }
+    kid := os.Getenv("jwt_kid")
+    if strings.HasPrefix(alg, "HS") {
+        obj.Keys = append(obj.Keys, &JwtKey{Kid: kid, Alg: alg, Key: obj.secretBytes})
+    }else{
+        key, err := LoadJwtKey(kid, alg, os.Getenv("jwt_private_key"))
+        if err != nil {
+            return err
+        }
+        obj.Keys = append(obj.Keys, key)
+    }
+    for _, item := range strings.Split(os.Getenv("jwt_verify_keys"), ",") {
+        if item = strings.TrimSpace(item); item == "" {
+            continue
+        }
+        parts := strings.SplitN(item, "=", 2)
+        if len(parts) != 2 {
+            return fmt.Errorf("jwt: wrong verify key %s, should be kid=file", item)
+        }
+        key, err := LoadJwtKey(parts[0], "", parts[1])
+        if err != nil {
+            return err
+        }
+        obj.Keys = append(obj.Keys, key)
+    }
+    return nil
+}
+
+// the first key able to sign
+func (obj *Jwt) signingKey() *JwtKey {
+    for _, key := range obj.Keys {
+        if key.Key != nil {
+            return key
+        }
+    }
+    return nil
+}
+
+// key func of jwt.Parse. the key is chosen by kid, and its algorithm must match the token's
+func (obj *Jwt) keyFunc(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    for _, key := range obj.Keys {
+        if key.Kid != kid {
+            continue
+        }
+        if token.Method == nil || token.Method.Alg() != key.Alg {
+            return nil, errJwtAlg
+        }
+        return key.verifyKey(), nil
+    }
+    return nil, fmt.Errorf("jwt: unknown kid %q", kid)
+}
+
+// handler. publish the public keys as a JWK set, secrets of HS* are never included
+func (obj *Jwt) JWKS(c *gin.Context) {
+    keys := []gin.H{}
+    for _, key := range obj.Keys {
+        if jwk := publicJwk(key); jwk != nil {
+            keys = append(keys, jwk)
+        }
+    }
+    c.Header("Cache-Control", "public, max-age=300")
+    c.JSON(200, gin.H{"keys": keys})
+}
+
+// JWK set of the default Jwt
+func JwtJWKS() gin.HandlerFunc {
+    return getInstance().JWKS
+}
+
+func b64(bytes []byte) string {
+    return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// fixed size big-endian bytes of a coordinate
+func padded(n *big.Int, size int) []byte {
+    bytes := n.Bytes()
+    if len(bytes) >= size {
+        return bytes
+    }
+    ret := make([]byte, size)
+    copy(ret[size - len(bytes):], bytes)
+    return ret
+}
+
+func publicJwk(key *JwtKey) gin.H {
+    jwk := gin.H{"kid": key.Kid, "alg": key.Alg, "use": "sig"}
+    switch k := key.PublicKey.(type) {
+    case *rsa.PublicKey:
+        jwk["kty"] = "RSA"
+        jwk["n"] = b64(k.N.Bytes())
+        jwk["e"] = b64(big.NewInt(int64(k.E)).Bytes())
+    case *ecdsa.PublicKey:
+        size := (k.Curve.Params().BitSize + 7) / 8
+        jwk["kty"] = "EC"
+        jwk["crv"] = k.Curve.Params().Name
+        jwk["x"] = b64(padded(k.X, size))
+        jwk["y"] = b64(padded(k.Y, size))
+    case ed25519.PublicKey:
+        jwk["kty"] = "OKP"
+        jwk["crv"] = "Ed25519"
+        jwk["x"] = b64(k)
+    default:
+        return nil
+    }
+    return jwk
+}
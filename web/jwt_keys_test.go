@@ -0,0 +1,110 @@
+package web
+
+import "testing"
+import "strings"
+import "encoding/json"
+import "net/http/httptest"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+import "crypto/elliptic"
+import "crypto/x509"
+import "encoding/pem"
+
+import "github.com/gin-gonic/gin"
+import "github.com/dgrijalva/jwt-go"
+
+func Test_JwtAsymmetric(t *testing.T) {
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    _, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+    for _, key := range []*JwtKey{
+        {Kid: "rs", Alg: "RS256", Key: rsaKey},
+        {Kid: "es", Alg: "ES256", Key: ecKey},
+        {Kid: "ed", Alg: "EdDSA", Key: edKey},
+    } {
+        obj := &Jwt{Keys: []*JwtKey{key}}
+        obj.Init()
+        token, err := obj.signClaims(obj.newClaims(`"jack"`, "", "", "", obj.Expire))
+        if err != nil {
+            t.Fatalf("%s: %v", key.Alg, err)
+        }
+        if claims, err := obj.validate(token); err != nil || claims.Payload != `"jack"` {
+            t.Errorf("%s: %v", key.Alg, err)
+        }
+    }
+
+    // wrong curve
+    if err := (&JwtKey{Alg: "ES384", Key: ecKey}).init(); err == nil {
+        t.Error("ES384 with a P-256 key should fail")
+    }
+}
+
+func Test_JwtKeyRotation(t *testing.T) {
+    oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    old := &Jwt{Keys: []*JwtKey{{Kid: "old", Alg: "RS256", Key: oldKey}}}
+    old.Init()
+    oldToken, _ := old.signClaims(old.newClaims(`1`, "", "", "", old.Expire))
+
+    pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&oldKey.PublicKey)})
+    verifyOnly, err := ParseJwtKey("old", "", pemBytes)
+    if err != nil || verifyOnly.Alg != "RS256" || verifyOnly.Key != nil {
+        t.Fatalf("wrong public key: %+v %v", verifyOnly, err)
+    }
+    obj := &Jwt{Keys: []*JwtKey{{Kid: "new", Alg: "RS256", Key: newKey}, verifyOnly}}
+    obj.Init()
+    if _, err := obj.validate(oldToken); err != nil {
+        t.Errorf("token of the old key should be verified: %v", err)
+    }
+    newToken, _ := obj.signClaims(obj.newClaims(`1`, "", "", "", obj.Expire))
+    if header := strings.Split(newToken, ".")[0]; !strings.Contains(string(mustDecode(header)), `"kid":"new"`) {
+        t.Errorf("kid should be in the header: %s", mustDecode(header))
+    }
+
+    // JWKS publishes both public keys
+    w := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(w)
+    obj.JWKS(c)
+    var jwks struct {
+        Keys []map[string]string `json:"keys"`
+    }
+    json.Unmarshal(w.Body.Bytes(), &jwks)
+    if len(jwks.Keys) != 2 || jwks.Keys[0]["kid"] != "new" || jwks.Keys[0]["kty"] != "RSA" || jwks.Keys[0]["e"] != "AQAB" {
+        t.Errorf("wrong jwks: %s", w.Body.String())
+    }
+}
+
+func Test_JwtAlgorithmConfusion(t *testing.T) {
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    obj := &Jwt{Keys: []*JwtKey{{Kid: "rs", Alg: "RS256", Key: rsaKey}}}
+    obj.Init()
+
+    // HS256 signed with the public key as the secret
+    publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(&rsaKey.PublicKey)})
+    forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &MyClaims{Payload: "1"})
+    forged.Header["kid"] = "rs"
+    token, _ := forged.SignedString(publicPem)
+    if _, err := obj.validate(token); err == nil {
+        t.Error("HS256 token should be rejected by an RS256 key")
+    }
+    // alg none
+    none := jwt.NewWithClaims(jwt.SigningMethodNone, &MyClaims{Payload: "1"})
+    none.Header["kid"] = "rs"
+    token, _ = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+    if _, err := obj.validate(token); err == nil {
+        t.Error("alg none should be rejected")
+    }
+}
+
+func mustDecode(seg string) []byte {
+    bytes, _ := jwt.DecodeSegment(seg)
+    return bytes
+}
+
+func mustMarshalPKIX(key interface{}) []byte {
+    bytes, _ := x509.MarshalPKIXPublicKey(key)
+    return bytes
+}
@@ -0,0 +1,181 @@
+// access/refresh token pairs
+
+package web
+
+import "time"
+import "errors"
+import "context"
+
+import "github.com/gin-gonic/gin"
+import "github.com/google/uuid"
+
+/*
+login issues a short-lived access token and a refresh token of a new family.
+the family is a session living RefreshExpire seconds, which bounds the whole login.
+
+- refresh tokens rotate: each one can be used once, and is replaced by a new pair
+- a used refresh token presented again means it leaked, the whole family is revoked
+- the middleware re-issues access tokens of a family within RenewBefore seconds of expiry,
+  into the header X-Renewed-Token, and the cookie when the request came with it.
+  each access token is renewed once, later requests with it get no new token
+
+it needs a session store, see JwtUseSessions.
+
+usage:
+  web.JwtUseSessions(storage.NewPgSessionStore(client))
+  r.POST("/login", func(c *gin.Context) { ...; web.JwtSetTokenCookies(c, user) })
+  r.POST("/token/refresh", web.JwtRefreshHandler())
+*/
+
+const JWT_REFRESH_COOKIE_KEY string = "JWT_REFRESH"
+const JWT_RENEW_HEADER string = "X-Renewed-Token"
+
+var ErrNoSessionStore = errors.New("jwt: refresh tokens need a session store")
+var ErrInvalidRefreshToken = errors.New("jwt: invalid refresh token")
+var ErrRefreshTokenReused = errors.New("jwt: refresh token reused")
+
+type TokenPair struct {
+    AccessToken string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType string `json:"token_type"`
+    ExpiresIn int `json:"expires_in"`  // seconds of the access token
+}
+
+// issue a token pair of a new family
+func (obj *Jwt) IssuePair(ctx context.Context, v interface{}) (*TokenPair, error) {
+    payload, err := jsonString(v)
+    if err != nil {
+        return nil, err
+    }
+    return obj.issuePair(ctx, payload, subjectOf(v), "")
+}
+
+func (obj *Jwt) issuePair(ctx context.Context, payload string, subject string, family string) (*TokenPair, error) {
+    if obj.Sessions == nil {
+        return nil, ErrNoSessionStore
+    }
+    if family == "" {
+        family = uuid.New().String()
+        if err := obj.Sessions.Create(ctx, family, time.Now().Add(time.Duration(obj.RefreshExpire) * time.Second)); err != nil {
+            return nil, err
+        }
+    }
+    access, err := obj.issue(ctx, obj.newClaims(payload, subject, "", family, obj.Expire))
+    if err != nil {
+        return nil, err
+    }
+    refresh, err := obj.issue(ctx, obj.newClaims(payload, subject, "refresh", family, obj.RefreshExpire))
+    if err != nil {
+        return nil, err
+    }
+    return &TokenPair{access, refresh, "Bearer", obj.Expire}, nil
+}
+
+// exchange a refresh token for a new pair
+func (obj *Jwt) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+    if obj.Sessions == nil {
+        return nil, ErrNoSessionStore
+    }
+    claims, err := obj.validate(refreshToken)
+    if err != nil || claims.Type != "refresh" || claims.Family == "" {
+        return nil, ErrInvalidRefreshToken
+    }
+    if active, err := obj.Sessions.Active(ctx, claims.Family); err != nil {
+        return nil, err
+    }else if !active {
+        return nil, ErrInvalidRefreshToken
+    }
+    // consume the token in one step, so that of concurrent refreshes only one wins
+    if consumed, err := obj.Sessions.Revoke(ctx, claims.Id); err != nil {
+        return nil, err
+    }else if !consumed {
+        // used before
+        log.Warnf("jwt: refresh token reused, family %s revoked", claims.Family)
+        if _, err2 := obj.Sessions.Revoke(ctx, claims.Family); err2 != nil {
+            return nil, err2
+        }
+        return nil, ErrRefreshTokenReused
+    }
+    return obj.issuePair(ctx, claims.Payload, claims.Subject, claims.Family)
+}
+
+func (obj *Jwt) setPairCookies(c *gin.Context, pair *TokenPair) {
+    obj.Cookie.Set(c, JWT_COOKIE_KEY, pair.AccessToken, obj.Expire)
+    obj.Cookie.Set(c, JWT_REFRESH_COOKIE_KEY, pair.RefreshToken, obj.RefreshExpire)
+}
+
+// issue a pair and set cookies. use it in LOGIN handler
+func (obj *Jwt) SetTokenCookies(c *gin.Context, v interface{}) (*TokenPair, error) {
+    pair, err := obj.IssuePair(c.Request.Context(), v)
+    if err != nil {
+        return nil, err
+    }
+    obj.setPairCookies(c, pair)
+    return pair, nil
+}
+
+// handler. the refresh token is read from the cookie JWT_REFRESH, or the field refresh_token of a JSON or form body.
+// responds the new pair, and sets cookies when it came from the cookie.
+func (obj *Jwt) RefreshHandler(c *gin.Context) {
+    fromCookie := true
+    refreshToken, _ := obj.Cookie.Get(c, JWT_REFRESH_COOKIE_KEY)
+    if refreshToken == "" {
+        fromCookie = false
+        var body struct {
+            RefreshToken string `json:"refresh_token" form:"refresh_token"`
+        }
+        c.ShouldBind(&body)
+        refreshToken = body.RefreshToken
+    }
+    pair, err := obj.Refresh(c.Request.Context(), refreshToken)
+    switch err {
+    case nil:
+    case ErrInvalidRefreshToken, ErrRefreshTokenReused:
+        c.JSON(401, gin.H{"message": "invalid token"})
+        c.Abort()
+        return
+    default:
+        log.Errorf("jwt refresh: %v", err)
+        ServiceUnavailable(c, nil)
+        return
+    }
+    if fromCookie {
+        obj.setPairCookies(c, pair)
+    }
+    c.JSON(200, pair)
+}
+
+// re-issue an access token of a family close to expiry, once per token.
+// the new jti derives from the old one, so a client that keeps sending the old token doesn't pile up sessions
+func (obj *Jwt) renew(c *gin.Context, claims *MyClaims) {
+    if claims.Family == "" || obj.Sessions == nil || claims.ExpiresAt - time.Now().Unix() > int64(obj.RenewBefore) {
+        return
+    }
+    ctx := c.Request.Context()
+    renewed := obj.newClaims(claims.Payload, claims.Subject, "", claims.Family, obj.Expire)
+    renewed.Id = uuid.NewSHA1(uuid.NameSpaceOID, []byte(claims.Id)).String()
+    if done, err := obj.Sessions.Active(ctx, renewed.Id); err != nil || done {
+        if err != nil {
+            log.Errorf("jwt renew: %v", err)
+        }
+        return
+    }
+    token, err := obj.issue(ctx, renewed)
+    if err != nil {
+        log.Errorf("jwt renew: %v", err)
+        return
+    }
+    c.Header(JWT_RENEW_HEADER, token)
+    if cookie, _ := obj.Cookie.Get(c, JWT_COOKIE_KEY); cookie != "" {
+        obj.Cookie.Set(c, JWT_COOKIE_KEY, token, obj.Expire)
+    }
+}
+
+// issue a pair and set cookies with the default Jwt
+func JwtSetTokenCookies(c *gin.Context, v interface{}) (*TokenPair, error) {
+    return getInstance().SetTokenCookies(c, v)
+}
+
+func JwtRefreshHandler() gin.HandlerFunc {
+    return getInstance().RefreshHandler
+}
@@ -0,0 +1,102 @@
+// where the JWT middleware reads tokens from
+
+package web
+
+import "os"
+import "strings"
+
+import "github.com/gin-gonic/gin"
+
+// returns the token of a request, or "" when absent
+type TokenSource func(c *gin.Context) string
+
+// Authorization: Bearer <token>
+func FromBearer() TokenSource {
+    return func(c *gin.Context) string {
+        auth := c.GetHeader("Authorization")
+        if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+            return strings.TrimSpace(auth[7:])
+        }
+        return ""
+    }
+}
+
+func FromCookie(name string) TokenSource {
+    return func(c *gin.Context) string {
+        token, _ := c.Cookie(name)
+        return token
+    }
+}
+
+func FromQuery(name string) TokenSource {
+    return func(c *gin.Context) string {
+        return c.Query(name)
+    }
+}
+
+// the whole value of a custom header, e.g. X-Token
+func FromHeader(name string) TokenSource {
+    return func(c *gin.Context) string {
+        return c.GetHeader(name)
+    }
+}
+
+/*
+parse sources from a comma separated list, e.g. env jwt_sources:
+  bearer          Authorization: Bearer
+  cookie          the JWT_TOKEN cookie, or cookie:<name>
+  query:<name>    query parameter
+  header:<name>   custom header
+*/
+func ParseTokenSources(spec string) []TokenSource {
+    return parseTokenSources(spec, JWT_COOKIE_KEY)
+}
+
+func parseTokenSources(spec string, cookieName string) []TokenSource {
+    var sources []TokenSource
+    for _, item := range strings.Split(spec, ",") {
+        kind, name := strings.TrimSpace(item), ""
+        if i := strings.Index(kind, ":"); i > 0 {
+            kind, name = kind[:i], strings.TrimSpace(kind[i + 1:])
+        }
+        switch strings.ToLower(kind) {
+        case "bearer":
+            sources = append(sources, FromBearer())
+        case "cookie":
+            if name == "" {
+                name = cookieName
+            }
+            sources = append(sources, FromCookie(name))
+        case "query":
+            if name != "" {
+                sources = append(sources, FromQuery(name))
+            }
+        case "header":
+            if name != "" {
+                sources = append(sources, FromHeader(name))
+            }
+        case "":
+        default:
+            log.Warnf("jwt: unknown token source %s", item)
+        }
+    }
+    return sources
+}
+
+// default: env jwt_sources, or bearer then cookie
+func defaultTokenSources(cookieName string) []TokenSource {
+    if spec := os.Getenv("jwt_sources"); spec != "" {
+        return parseTokenSources(spec, cookieName)
+    }
+    return []TokenSource{FromBearer(), FromCookie(cookieName)}
+}
+
+// the first token found in order
+func (obj *Jwt) extract(c *gin.Context) string {
+    for _, source := range obj.Sources {
+        if token := source(c); token != "" {
+            return token
+        }
+    }
+    return ""
+}
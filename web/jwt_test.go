@@ -0,0 +1,226 @@
+package web
+
+import "testing"
+import "context"
+import "strings"
+import "sync"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/gin-gonic/gin"
+import "github.com/jackielihf/golib/storage"
+
+func newJwtEngine(obj *Jwt) *gin.Engine {
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    r.GET("/me", obj.Ware, func(c *gin.Context) {
+        claims, _ := JwtRawClaims(c)
+        c.String(200, claims.Payload)
+    })
+    return r
+}
+
+func Test_JwtSources(t *testing.T) {
+    obj := &Jwt{Secret: "secret", Sources: ParseTokenSources("bearer,query:token")}
+    obj.Init()
+    r := newJwtEngine(obj)
+    token, _ := obj.Issue(context.Background(), map[string]string{"name": "jack"})
+
+    cases := []struct {
+        name string
+        setup func(req *http.Request)
+        code int
+    }{
+        {"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer " + token) }, 200},
+        {"query", func(req *http.Request) { req.URL.RawQuery = "token=" + token }, 200},
+        {"cookie not configured", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: token}) }, 401},
+        {"bad token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer x" + token) }, 401},
+    }
+    for _, c := range cases {
+        req := httptest.NewRequest("GET", "/me", nil)
+        c.setup(req)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        if w.Code != c.code {
+            t.Errorf("%s: expected %d, got %d", c.name, c.code, w.Code)
+        }
+        if w.Code == 200 && w.Body.String() != `{"name":"jack"}` {
+            t.Errorf("%s: wrong user ctx %s", c.name, w.Body.String())
+        }
+    }
+}
+
+func Test_JwtSessions(t *testing.T) {
+    obj := &Jwt{Secret: "secret", Sessions: storage.NewMemorySessionStore()}
+    obj.Init()
+    r := newJwtEngine(obj)
+    r.GET("/logout", obj.ClearCookie)
+    token, err := obj.Issue(context.Background(), "jack")
+    if err != nil {
+        t.Fatal(err)
+    }
+    get := func(path string) int {
+        req := httptest.NewRequest("GET", path, nil)
+        req.Header.Set("Authorization", "Bearer " + token)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w.Code
+    }
+    if code := get("/me"); code != 200 {
+        t.Fatalf("active session should pass, got %d", code)
+    }
+    get("/logout")
+    if code := get("/me"); code != 401 {
+        t.Errorf("revoked session should be rejected, got %d", code)
+    }
+}
+
+func Test_JwtRefresh(t *testing.T) {
+    ctx := context.Background()
+    obj := &Jwt{Secret: "secret", Sessions: storage.NewMemorySessionStore()}
+    obj.Init()
+    pair, err := obj.IssuePair(ctx, "jack")
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := newJwtEngine(obj)
+    get := func(token string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("GET", "/me", nil)
+        req.Header.Set("Authorization", "Bearer " + token)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w
+    }
+    if w := get(pair.RefreshToken); w.Code != 401 {
+        t.Errorf("refresh token should not be accepted as an access token, got %d", w.Code)
+    }
+
+    // rotation
+    next, err := obj.Refresh(ctx, pair.RefreshToken)
+    if err != nil || next.RefreshToken == pair.RefreshToken {
+        t.Fatalf("refresh should rotate: %v", err)
+    }
+    if w := get(next.AccessToken); w.Code != 200 || w.Header().Get(JWT_RENEW_HEADER) != "" {
+        t.Errorf("new access token should pass without renewal, got %d", w.Code)
+    }
+
+    // reuse revokes the family
+    if _, err := obj.Refresh(ctx, pair.RefreshToken); err != ErrRefreshTokenReused {
+        t.Errorf("reuse should be detected, got %v", err)
+    }
+    if _, err := obj.Refresh(ctx, next.RefreshToken); err != ErrInvalidRefreshToken {
+        t.Errorf("family should be revoked, got %v", err)
+    }
+    if w := get(next.AccessToken); w.Code != 401 {
+        t.Errorf("access tokens of a revoked family should be rejected, got %d", w.Code)
+    }
+}
+
+func Test_JwtRenew(t *testing.T) {
+    obj := &Jwt{Secret: "secret", Sessions: storage.NewMemorySessionStore(), Expire: 60, RenewBefore: 60}
+    obj.Init()
+    pair, _ := obj.IssuePair(context.Background(), "jack")
+    r := newJwtEngine(obj)
+    req := httptest.NewRequest("GET", "/me", nil)
+    req.AddCookie(&http.Cookie{Name: JWT_COOKIE_KEY, Value: pair.AccessToken})
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    renewed := w.Header().Get(JWT_RENEW_HEADER)
+    if w.Code != 200 || renewed == "" || renewed == pair.AccessToken {
+        t.Fatalf("access token close to expiry should be renewed, got %d", w.Code)
+    }
+    if cookie := w.Header().Get("Set-Cookie"); !strings.Contains(cookie, renewed) {
+        t.Errorf("renewed token should be set into the cookie: %s", cookie)
+    }
+    // the old token still passes, without another renewal
+    for i := 0; i < 3; i++ {
+        w = httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        if w.Code != 200 || w.Header().Get(JWT_RENEW_HEADER) != "" {
+            t.Fatalf("a token should be renewed once, got %d %s", w.Code, w.Header().Get(JWT_RENEW_HEADER))
+        }
+    }
+}
+
+func Test_JwtRefreshConcurrent(t *testing.T) {
+    ctx := context.Background()
+    obj := &Jwt{Secret: "secret", Sessions: storage.NewMemorySessionStore()}
+    obj.Init()
+    pair, _ := obj.IssuePair(ctx, "jack")
+    var mtx sync.Mutex
+    var pairs []*TokenPair
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            next, err := obj.Refresh(ctx, pair.RefreshToken)
+            if err == nil {
+                mtx.Lock()
+                pairs = append(pairs, next)
+                mtx.Unlock()
+            }else if err != ErrRefreshTokenReused && err != ErrInvalidRefreshToken {
+                t.Errorf("unexpected err: %v", err)
+            }
+        }()
+    }
+    wg.Wait()
+    if len(pairs) != 1 {
+        t.Fatalf("exactly one refresh should succeed, got %d", len(pairs))
+    }
+    // the losers revoked the family
+    if _, err := obj.Refresh(ctx, pairs[0].RefreshToken); err != ErrInvalidRefreshToken {
+        t.Errorf("family should be revoked, got %v", err)
+    }
+}
+
+type testUser struct {
+    Id string `json:"id"`
+    Name string `json:"name"`
+}
+
+func (u testUser) JwtSubject() string {
+    return u.Id
+}
+
+func Test_JwtClaims(t *testing.T) {
+    obj := &Jwt{Secret: "secret", Issuer: "golib", Audience: "api"}
+    obj.Init()
+    token, _ := obj.Issue(context.Background(), testUser{"1", "jack"})
+
+    gin.SetMode(gin.TestMode)
+    r := gin.New()
+    var claims *Claims[testUser]
+    var forged string
+    r.GET("/me", obj.Ware, func(c *gin.Context) {
+        claims, _ = JwtClaims[testUser](c)
+        forged = c.Request.Header.Get(JWT_OBJ_KEY)
+    })
+    req := httptest.NewRequest("GET", "/me", nil)
+    req.Header.Set("Authorization", "Bearer " + token)
+    req.Header.Set(JWT_OBJ_KEY, `{"id":"0"}`)
+    r.ServeHTTP(httptest.NewRecorder(), req)
+    if claims == nil || claims.Data.Name != "jack" || claims.Subject != "1" || claims.Issuer != "golib" || claims.ExpiresAt.IsZero() {
+        t.Fatalf("wrong claims: %+v", claims)
+    }
+    if forged != "" {
+        t.Error("incoming user_ctx header should be stripped")
+    }
+
+    // issuer, audience and clock skew
+    other := &Jwt{Secret: "secret", Audience: "admin"}
+    other.Init()
+    if _, err := other.validate(token); err == nil {
+        t.Error("wrong audience should be rejected")
+    }
+    early := obj.newClaims("1", "", "", "", 60)
+    early.NotBefore += 30
+    earlyToken, _ := obj.signClaims(early)
+    if _, err := obj.validate(earlyToken); err == nil {
+        t.Error("token before nbf should be rejected")
+    }
+    obj.ClockSkew = 60
+    if _, err := obj.validate(earlyToken); err != nil {
+        t.Errorf("token within the clock skew should pass: %v", err)
+    }
+}
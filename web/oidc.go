@@ -0,0 +1,541 @@
+// OpenID Connect login, as a relying party of an identity provider
+
+package web
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "errors"
+import "strings"
+import "context"
+import "net/url"
+import "net/http"
+import "math/big"
+import "io/ioutil"
+import "crypto/rsa"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/json"
+import "encoding/base64"
+
+import "github.com/gin-gonic/gin"
+import "github.com/dgrijalva/jwt-go"
+
+/*
+authorization code flow with PKCE:
+  1. the login handler redirects to the provider, with a random state, nonce and code verifier kept in the cookie OIDC_STATE
+  2. the provider redirects back to the callback handler, which checks the state,
+     exchanges the code for an ID token, and verifies it by the provider's JWKS, issuer, audience, expiry and nonce
+  3. the claims of the ID token are mapped to a payload, which is signed into the JWT cookie like JwtSetCookie
+
+endpoints are discovered from <issuer>/.well-known/openid-configuration.
+
+env variables:
+  oidc_issuer         e.g. https://sso.example.com/realms/corp
+  oidc_client_id
+  oidc_client_secret  empty for public clients
+  oidc_redirect_url   URL of the callback handler, a path is relative to the request's host. default: /oidc/callback
+  oidc_scopes         space separated. default: openid profile email
+
+usage:
+  sso := web.NewOidc()
+  r.GET("/oidc/login", sso.LoginHandler)  // ?next=/dashboard
+  r.GET("/oidc/callback", sso.CallbackHandler)
+
+  // custom payload, an error denies the login with 403
+  sso.Claims = func(claims map[string]interface{}) (interface{}, error) {
+      return MyUser{Id: claims["sub"].(string), Roles: claims["groups"]}, nil
+  }
+*/
+
+const OIDC_STATE_COOKIE_KEY string = "OIDC_STATE"
+const oidcStateExpire int = 60 * 10
+
+var ErrOidcState = errors.New("oidc: state mismatch")
+var ErrOidcNonce = errors.New("oidc: nonce mismatch")
+var ErrOidcIdToken = errors.New("oidc: invalid id token")
+
+// default payload of the JWT
+type OidcUser struct {
+    Id string `json:"id"`
+    Email string `json:"email,omitempty"`
+    Name string `json:"name,omitempty"`
+}
+
+func (u OidcUser) JwtSubject() string { return u.Id }
+
+type Oidc struct {
+    Issuer string  // default: env oidc_issuer
+    ClientId string  // default: env oidc_client_id
+    ClientSecret string  // default: env oidc_client_secret
+    RedirectURL string  // default: env oidc_redirect_url, or /oidc/callback
+    Scopes []string  // default: env oidc_scopes, or openid profile email
+    Claims func(claims map[string]interface{}) (interface{}, error)  // ID token claims -> JWT payload. default: OidcUser
+    Jwt *Jwt  // signs the session. default: the default Jwt
+    Client *http.Client  // default: 10 seconds timeout
+    ClockSkew int  // seconds tolerated when checking exp and iat. default: 60
+
+    mtx sync.Mutex
+    config *oidcConfig
+    keys []*JwtKey
+    keysAt time.Time
+}
+
+// discovery document
+type oidcConfig struct {
+    Issuer string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint string `json:"token_endpoint"`
+    JwksUri string `json:"jwks_uri"`
+}
+
+// kept in the cookie between login and callback
+type oidcState struct {
+    State string `json:"s"`
+    Nonce string `json:"n"`
+    Verifier string `json:"v"`
+    Next string `json:"r"`
+}
+
+// with env settings
+func NewOidc() *Oidc {
+    obj := new(Oidc)
+    obj.Init()
+    return obj
+}
+
+func (obj *Oidc) Init() {
+    if obj.Issuer == "" {
+        obj.Issuer = os.Getenv("oidc_issuer")
+    }
+    obj.Issuer = strings.TrimRight(obj.Issuer, "/")
+    if obj.ClientId == "" {
+        obj.ClientId = os.Getenv("oidc_client_id")
+    }
+    if obj.ClientSecret == "" {
+        obj.ClientSecret = os.Getenv("oidc_client_secret")
+    }
+    if obj.RedirectURL == "" {
+        obj.RedirectURL = os.Getenv("oidc_redirect_url")
+    }
+    if obj.RedirectURL == "" {
+        obj.RedirectURL = "/oidc/callback"
+    }
+    if len(obj.Scopes) == 0 {
+        obj.Scopes = strings.Fields(os.Getenv("oidc_scopes"))
+    }
+    if len(obj.Scopes) == 0 {
+        obj.Scopes = []string{"openid", "profile", "email"}
+    }
+    if obj.Claims == nil {
+        obj.Claims = defaultOidcClaims
+    }
+    if obj.Jwt == nil {
+        obj.Jwt = getInstance()
+    }
+    if obj.Client == nil {
+        obj.Client = &http.Client{Timeout: 10 * time.Second}
+    }
+    if obj.ClockSkew < 1 {
+        obj.ClockSkew = 60
+    }
+}
+
+func defaultOidcClaims(claims map[string]interface{}) (interface{}, error) {
+    user := OidcUser{}
+    user.Id, _ = claims["sub"].(string)
+    user.Email, _ = claims["email"].(string)
+    user.Name, _ = claims["name"].(string)
+    return user, nil
+}
+
+func randomString() string {
+    bytes := make([]byte, 32)
+    rand.Read(bytes)
+    return b64(bytes)
+}
+
+// only local paths, so the callback can't redirect to other sites
+func localPath(next string) string {
+    if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+        return "/"
+    }
+    return next
+}
+
+// the state cookie is sent back by the provider's top-level redirect, which SameSite=Strict blocks
+func (obj *Oidc) stateCookie() *CookiePolicy {
+    policy := *obj.Jwt.Cookie
+    policy.HttpOnly = true
+    if policy.SameSite == http.SameSiteStrictMode {
+        policy.SameSite = http.SameSiteLaxMode
+    }
+    return &policy
+}
+
+func (obj *Oidc) redirectURL(c *gin.Context) string {
+    if strings.HasPrefix(obj.RedirectURL, "/") {
+        return requestOrigin(c) + obj.RedirectURL
+    }
+    return obj.RedirectURL
+}
+
+func (obj *Oidc) getJSON(ctx context.Context, url string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := obj.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 200 {
+        return fmt.Errorf("oidc: %s responds %d", url, resp.StatusCode)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// the discovery document, fetched once
+func (obj *Oidc) discover(ctx context.Context) (*oidcConfig, error) {
+    obj.mtx.Lock()
+    defer obj.mtx.Unlock()
+    if obj.config != nil {
+        return obj.config, nil
+    }
+    config := new(oidcConfig)
+    if err := obj.getJSON(ctx, obj.Issuer + "/.well-known/openid-configuration", config); err != nil {
+        return nil, err
+    }
+    if strings.TrimRight(config.Issuer, "/") != obj.Issuer {
+        return nil, fmt.Errorf("oidc: discovered issuer %s, expected %s", config.Issuer, obj.Issuer)
+    }
+    obj.config = config
+    return config, nil
+}
+
+// handler. redirect to the provider, ?next= is the local path to return to
+func (obj *Oidc) LoginHandler(c *gin.Context) {
+    config, err := obj.discover(c.Request.Context())
+    if err != nil {
+        log.Errorf("oidc: %v", err)
+        ServiceUnavailable(c, nil)
+        return
+    }
+    state := oidcState{randomString(), randomString(), randomString(), localPath(c.Query("next"))}
+    data, _ := json.Marshal(state)
+    obj.stateCookie().Set(c, OIDC_STATE_COOKIE_KEY, base64.RawURLEncoding.EncodeToString(data), oidcStateExpire)
+
+    challenge := sha256.Sum256([]byte(state.Verifier))
+    query := url.Values{
+        "response_type": {"code"},
+        "client_id": {obj.ClientId},
+        "redirect_uri": {obj.redirectURL(c)},
+        "scope": {strings.Join(obj.Scopes, " ")},
+        "state": {state.State},
+        "nonce": {state.Nonce},
+        "code_challenge": {b64(challenge[:])},
+        "code_challenge_method": {"S256"},
+    }
+    sep := "?"
+    if strings.Contains(config.AuthorizationEndpoint, "?") {
+        sep = "&"
+    }
+    c.Redirect(302, config.AuthorizationEndpoint + sep + query.Encode())
+    c.Abort()
+}
+
+// handler. verify the provider's response, set the JWT cookie and redirect to next.
+// 401 for a failed login, 403 when Claims denies it
+func (obj *Oidc) CallbackHandler(c *gin.Context) {
+    policy := obj.stateCookie()
+    raw, _ := policy.Get(c, OIDC_STATE_COOKIE_KEY)
+    policy.Clear(c, OIDC_STATE_COOKIE_KEY)
+    var state oidcState
+    if data, err := base64.RawURLEncoding.DecodeString(raw); err != nil || json.Unmarshal(data, &state) != nil || state.State == "" {
+        log.Warnf("oidc: no state cookie")
+        Unauthorized(c, nil)
+        return
+    }
+    if e := c.Query("error"); e != "" {
+        log.Warnf("oidc: %s %s", e, c.Query("error_description"))
+        Unauthorized(c, nil)
+        return
+    }
+    if subtle.ConstantTimeCompare([]byte(state.State), []byte(c.Query("state"))) != 1 {
+        log.Warnf("%v", ErrOidcState)
+        Unauthorized(c, nil)
+        return
+    }
+    claims, err := obj.Exchange(c.Request.Context(), c.Query("code"), state.Verifier, obj.redirectURL(c), state.Nonce)
+    if err != nil {
+        log.Warnf("oidc: %v", err)
+        if err == ErrOidcIdToken || err == ErrOidcNonce {
+            Unauthorized(c, nil)
+        }else{
+            ServiceUnavailable(c, nil)
+        }
+        return
+    }
+    payload, err := obj.Claims(claims)
+    if err != nil {
+        log.Warnf("oidc: %s denied: %v", claims["sub"], err)
+        Forbidden(c, nil)
+        return
+    }
+    token, err := obj.Jwt.Issue(c.Request.Context(), payload)
+    if err != nil {
+        log.Errorf("jwt: %v", err)
+        ServiceUnavailable(c, nil)
+        return
+    }
+    obj.Jwt.Cookie.Set(c, JWT_COOKIE_KEY, token, obj.Jwt.Expire)
+    c.Redirect(302, localPath(state.Next))
+    c.Abort()
+}
+
+// exchange the code at the token endpoint, and return the verified claims of the ID token
+func (obj *Oidc) Exchange(ctx context.Context, code string, verifier string, redirectURL string, nonce string) (map[string]interface{}, error) {
+    config, err := obj.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    form := url.Values{
+        "grant_type": {"authorization_code"},
+        "code": {code},
+        "redirect_uri": {redirectURL},
+        "client_id": {obj.ClientId},
+        "code_verifier": {verifier},
+    }
+    req, err := http.NewRequestWithContext(ctx, "POST", config.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if obj.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(obj.ClientId), url.QueryEscape(obj.ClientSecret))
+    }
+    resp, err := obj.Client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    var tokens struct {
+        IdToken string `json:"id_token"`
+        Error string `json:"error"`
+    }
+    json.Unmarshal(body, &tokens)
+    if resp.StatusCode == 400 || resp.StatusCode == 401 {
+        // invalid_grant: a wrong, used or expired code, or a wrong verifier
+        log.Warnf("oidc: token endpoint responds %d %s", resp.StatusCode, tokens.Error)
+        return nil, ErrOidcIdToken
+    }
+    if resp.StatusCode != 200 {
+        return nil, fmt.Errorf("oidc: token endpoint responds %d", resp.StatusCode)
+    }
+    return obj.VerifyIdToken(ctx, tokens.IdToken, nonce)
+}
+
+// verify the signature and claims of an ID token
+func (obj *Oidc) VerifyIdToken(ctx context.Context, idToken string, nonce string) (map[string]interface{}, error) {
+    config, err := obj.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    parser := jwt.Parser{SkipClaimsValidation: true}
+    token, err := parser.ParseWithClaims(idToken, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
+        return obj.keyFunc(ctx, token)
+    })
+    if err != nil || !token.Valid {
+        log.Warnf("oidc: id token: %v", err)
+        return nil, ErrOidcIdToken
+    }
+    claims := token.Claims.(jwt.MapClaims)
+    if err = obj.checkClaims(claims, config.Issuer, nonce); err != nil {
+        log.Warnf("oidc: id token: %v", err)
+        if err == ErrOidcNonce {
+            return nil, err
+        }
+        return nil, ErrOidcIdToken
+    }
+    return claims, nil
+}
+
+func (obj *Oidc) checkClaims(claims jwt.MapClaims, issuer string, nonce string) error {
+    now := time.Now().Unix()
+    skew := int64(obj.ClockSkew)
+    exp, _ := claims["exp"].(float64)
+    iat, _ := claims["iat"].(float64)
+    sub, _ := claims["sub"].(string)
+    azp, _ := claims["azp"].(string)
+    var aud []string
+    switch v := claims["aud"].(type) {
+    case string:
+        aud = []string{v}
+    case []interface{}:
+        aud = claimStrings(v)
+    }
+    switch {
+    case claims["iss"] != issuer:
+        return errors.New("wrong issuer")
+    case !contains(aud, obj.ClientId):
+        return errors.New("wrong audience")
+    case len(aud) > 1 && azp != obj.ClientId:
+        return errors.New("wrong authorized party")
+    case exp == 0 || now > int64(exp) + skew:
+        return errors.New("token is expired")
+    case int64(iat) > now + skew:
+        return errors.New("token used before issued")
+    case sub == "":
+        return errors.New("no subject")
+    case claims["nonce"] != nonce:
+        return ErrOidcNonce
+    }
+    return nil
+}
+
+// the provider's key of the token's kid. keys are fetched again for an unknown kid, at most once a minute
+func (obj *Oidc) keyFunc(ctx context.Context, token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    obj.mtx.Lock()
+    keys, keysAt := obj.keys, obj.keysAt
+    obj.mtx.Unlock()
+    key := findKey(keys, kid)
+    if key == nil && time.Since(keysAt) > time.Minute {
+        var err error
+        if keys, err = obj.fetchKeys(ctx); err != nil {
+            return nil, err
+        }
+        key = findKey(keys, kid)
+    }
+    if key == nil {
+        return nil, fmt.Errorf("oidc: unknown kid %q", kid)
+    }
+    if token.Method == nil || token.Method.Alg() != key.Alg {
+        return nil, errJwtAlg
+    }
+    return key.PublicKey, nil
+}
+
+func findKey(keys []*JwtKey, kid string) *JwtKey {
+    for _, key := range keys {
+        // a single key may come without kid
+        if key.Kid == kid || (kid == "" && len(keys) == 1) {
+            return key
+        }
+    }
+    return nil
+}
+
+func (obj *Oidc) fetchKeys(ctx context.Context) ([]*JwtKey, error) {
+    config, err := obj.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var set struct {
+        Keys []jwk `json:"keys"`
+    }
+    if err = obj.getJSON(ctx, config.JwksUri, &set); err != nil {
+        return nil, err
+    }
+    var keys []*JwtKey
+    for _, item := range set.Keys {
+        if item.Use == "enc" {
+            continue
+        }
+        key, err := item.jwtKey()
+        if err != nil {
+            log.Warnf("oidc: jwk %s: %v", item.Kid, err)
+            continue
+        }
+        keys = append(keys, key)
+    }
+    obj.mtx.Lock()
+    obj.keys, obj.keysAt = keys, time.Now()
+    obj.mtx.Unlock()
+    return keys, nil
+}
+
+// public JSON web key
+type jwk struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Alg string `json:"alg"`
+    Use string `json:"use"`
+    Crv string `json:"crv"`
+    N string `json:"n"`
+    E string `json:"e"`
+    X string `json:"x"`
+    Y string `json:"y"`
+}
+
+func b64Decode(s string) ([]byte, error) {
+    return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func b64Int(s string) (*big.Int, error) {
+    bytes, err := b64Decode(s)
+    if err != nil || len(bytes) == 0 {
+        return nil, errors.New("bad integer")
+    }
+    return new(big.Int).SetBytes(bytes), nil
+}
+
+// a verification key. the alg is inferred when the jwk has none
+func (k jwk) jwtKey() (*JwtKey, error) {
+    key := &JwtKey{Kid: k.Kid, Alg: k.Alg}
+    switch k.Kty {
+    case "RSA":
+        n, err := b64Int(k.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := b64Int(k.E)
+        if err != nil || !e.IsInt64() {
+            return nil, errors.New("bad exponent")
+        }
+        key.PublicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+    case "EC":
+        curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+        if curve == nil {
+            return nil, fmt.Errorf("unknown curve %s", k.Crv)
+        }
+        x, err := b64Int(k.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := b64Int(k.Y)
+        if err != nil {
+            return nil, err
+        }
+        if !curve.IsOnCurve(x, y) {
+            return nil, errors.New("point not on curve")
+        }
+        key.PublicKey = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+    case "OKP":
+        x, err := b64Decode(k.X)
+        if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+            return nil, errors.New("bad Ed25519 key")
+        }
+        key.PublicKey = ed25519.PublicKey(x)
+    default:
+        return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+    }
+    if key.Alg == "" {
+        key.Alg = inferAlg(key)
+    }
+    if strings.HasPrefix(key.Alg, "HS") {
+        return nil, fmt.Errorf("symmetric alg %s", key.Alg)
+    }
+    return key, key.init()
+}
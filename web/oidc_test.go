@@ -0,0 +1,208 @@
+package web
+
+import "testing"
+import "strings"
+import "time"
+import "net/url"
+import "net/http"
+import "net/http/httptest"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "encoding/json"
+
+import "github.com/gin-gonic/gin"
+import "github.com/dgrijalva/jwt-go"
+
+// a stand-in identity provider
+type testIdp struct {
+    server *httptest.Server
+    key *JwtKey
+    codes map[string]url.Values  // code -> authorize query
+    claims func(claims jwt.MapClaims)  // tamper with issued claims
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+    privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &testIdp{key: &JwtKey{Kid: "idp-1", Alg: "RS256", Key: privateKey}, codes: map[string]url.Values{}}
+    if err = idp.key.init(); err != nil {
+        t.Fatal(err)
+    }
+    r := gin.New()
+    r.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+        c.JSON(200, gin.H{
+            "issuer": idp.server.URL,
+            "authorization_endpoint": idp.server.URL + "/authorize",
+            "token_endpoint": idp.server.URL + "/token",
+            "jwks_uri": idp.server.URL + "/jwks",
+        })
+    })
+    r.GET("/jwks", func(c *gin.Context) {
+        c.JSON(200, gin.H{"keys": []gin.H{publicJwk(idp.key)}})
+    })
+    // logs the user in at once
+    r.GET("/authorize", func(c *gin.Context) {
+        code := randomString()
+        idp.codes[code] = c.Request.URL.Query()
+        c.Redirect(302, c.Query("redirect_uri") + "?code=" + code + "&state=" + url.QueryEscape(c.Query("state")))
+    })
+    r.POST("/token", func(c *gin.Context) {
+        query, ok := idp.codes[c.PostForm("code")]
+        delete(idp.codes, c.PostForm("code"))
+        id, secret, _ := c.Request.BasicAuth()
+        challenge := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+        if !ok || id != "app" || secret != "secret" || b64(challenge[:]) != query.Get("code_challenge") || c.PostForm("redirect_uri") != query.Get("redirect_uri") {
+            c.JSON(400, gin.H{"error": "invalid_grant"})
+            return
+        }
+        now := time.Now().Unix()
+        claims := jwt.MapClaims{
+            "iss": idp.server.URL, "aud": "app", "sub": "u-1", "email": "u1@example.com",
+            "nonce": query.Get("nonce"), "iat": now, "exp": now + 300,
+        }
+        if idp.claims != nil {
+            idp.claims(claims)
+        }
+        token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+        token.Header["kid"] = idp.key.Kid
+        signed, _ := token.SignedString(idp.key.Key)
+        c.JSON(200, gin.H{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+    })
+    idp.server = httptest.NewServer(r)
+    return idp
+}
+
+func Test_Oidc(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    idp := newTestIdp(t)
+    defer idp.server.Close()
+
+    api := &Jwt{Secret: "oidc", Cookie: &CookiePolicy{}}
+    api.Init()
+    sso := &Oidc{Issuer: idp.server.URL, ClientId: "app", ClientSecret: "secret", Jwt: api}
+    sso.Init()
+    r := newJwtEngine(api)
+    r.GET("/oidc/login", sso.LoginHandler)
+    r.GET("/oidc/callback", sso.CallbackHandler)
+    noRedirect := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+
+    // login -> provider -> callback, returns the callback response
+    login := func(tamper func(location *url.URL, cookie *http.Cookie)) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, httptest.NewRequest("GET", "/oidc/login?next=/dashboard", nil))
+        if w.Code != 302 {
+            t.Fatalf("login should redirect, got %d", w.Code)
+        }
+        authorize := w.Header().Get("Location")
+        for _, param := range []string{"client_id=app", "response_type=code", "code_challenge_method=S256", "nonce=", "state=", "scope=openid"} {
+            if !strings.Contains(authorize, param) {
+                t.Errorf("%s should have %s", authorize, param)
+            }
+        }
+        cookie := w.Result().Cookies()[0]
+        resp, err := noRedirect.Get(authorize)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        location, _ := url.Parse(resp.Header.Get("Location"))
+        if tamper != nil {
+            tamper(location, cookie)
+        }
+        req := httptest.NewRequest("GET", location.RequestURI(), nil)
+        req.AddCookie(cookie)
+        w = httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w
+    }
+
+    w := login(nil)
+    if w.Code != 302 || w.Header().Get("Location") != "/dashboard" {
+        t.Fatalf("callback should redirect to next, got %d %s", w.Code, w.Header().Get("Location"))
+    }
+    var jwtCookie *http.Cookie
+    for _, cookie := range w.Result().Cookies() {
+        if cookie.Name == JWT_COOKIE_KEY {
+            jwtCookie = cookie
+        }
+    }
+    if jwtCookie == nil {
+        t.Fatal("callback should set the JWT cookie")
+    }
+    req := httptest.NewRequest("GET", "/me", nil)
+    req.AddCookie(jwtCookie)
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    if w.Code != 200 || !strings.Contains(w.Body.String(), "u1@example.com") {
+        t.Errorf("session should carry the claims: %d %s", w.Code, w.Body.String())
+    }
+
+    // state mismatch
+    w = login(func(location *url.URL, cookie *http.Cookie) {
+        query := location.Query()
+        query.Set("state", "forged")
+        location.RawQuery = query.Encode()
+    })
+    if w.Code != 401 {
+        t.Errorf("forged state should respond 401, got %d", w.Code)
+    }
+    // PKCE: a verifier of another login
+    w = login(func(location *url.URL, cookie *http.Cookie) {
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, httptest.NewRequest("GET", "/oidc/login", nil))
+        other := w.Result().Cookies()[0]
+        cookie.Value = other.Value
+        query := location.Query()
+        query.Set("state", oidcStateOf(t, other.Value))
+        location.RawQuery = query.Encode()
+    })
+    if w.Code != 401 {
+        t.Errorf("wrong verifier should respond 401, got %d", w.Code)
+    }
+
+    // tampered ID tokens
+    cases := map[string]func(claims jwt.MapClaims){
+        "nonce": func(claims jwt.MapClaims) { claims["nonce"] = "replayed" },
+        "audience": func(claims jwt.MapClaims) { claims["aud"] = "other" },
+        "issuer": func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" },
+        "expired": func(claims jwt.MapClaims) { claims["exp"] = time.Now().Unix() - 3600 },
+    }
+    for name, tamper := range cases {
+        idp.claims = tamper
+        if w = login(nil); w.Code != 401 {
+            t.Errorf("%s: should respond 401, got %d", name, w.Code)
+        }
+    }
+    idp.claims = nil
+
+    // claims mapping denies
+    sso.Claims = func(claims map[string]interface{}) (interface{}, error) {
+        return nil, ErrOidcIdToken
+    }
+    if w = login(nil); w.Code != 403 {
+        t.Errorf("denied login should respond 403, got %d", w.Code)
+    }
+}
+
+func oidcStateOf(t *testing.T, cookie string) string {
+    data, err := b64Decode(cookie)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var state oidcState
+    if err = json.Unmarshal(data, &state); err != nil {
+        t.Fatal(err)
+    }
+    return state.State
+}
+
+func Test_LocalPath(t *testing.T) {
+    for next, expected := range map[string]string{"/a?b=1": "/a?b=1", "": "/", "//evil.com": "/", "/\\evil.com": "/", "https://evil.com": "/"} {
+        if localPath(next) != expected {
+            t.Errorf("%q should be %q", next, expected)
+        }
+    }
+}
@@ -47,10 +47,22 @@ func NotFound(c *gin.Context, data map[string]interface{}) {
     respondError(c, 404, data)
 }
 
+func Conflict(c *gin.Context, data map[string]interface{}) {
+    respondError(c, 409, data)
+}
+
+func TooManyRequests(c *gin.Context, data map[string]interface{}) {
+    respondError(c, 429, data)
+}
+
 func ServerError(c *gin.Context, data map[string]interface{}) {
     respondError(c, 500, data)
 }
 
+func ServiceUnavailable(c *gin.Context, data map[string]interface{}) {
+    respondError(c, 503, data)
+}
+
 //cache
 func CacheControl(c *gin.Context, max int) {
     c.Header("Cache-Control", fmt.Sprintf("max-age=%d", max))
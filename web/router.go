@@ -16,6 +16,14 @@ type Api struct {
     Handlers ApiHandlers
 }
 
+// prepend middlewares to the handlers, e.g. web.RequireRoles("admin")
+func (that Api) Use(wares ...gin.HandlerFunc) Api {
+    handlers := make(ApiHandlers, 0, len(wares) + len(that.Handlers))
+    handlers = append(handlers, wares...)
+    that.Handlers = append(handlers, that.Handlers...)
+    return that
+}
+
 
 // create api routes
 func CreateApi(router *gin.Engine, config []Api) *gin.Engine{
@@ -36,6 +36,7 @@ var StatusCode = map[int]string {
     415: "Unsupported Media Type",
     416: "Requested range not satisfiable",
     417: "Expectation Failed",
+    429: "Too Many Requests",
     500: "Internal Server Error",
     501: "Not Implemented",
     502: "Bad Gateway",
@@ -8,17 +8,17 @@ import "github.com/gin-gonic/gin"
 const USER_TRACK_KEY string = "USER_TRACK"
 const longAfter int = 60 * 60 * 24 * 365 * 1000
 
+// with the cookie policy of env variables
 func UserTrack() gin.HandlerFunc {
+    return UserTrackWith(CookiePolicyFromEnv())
+}
+
+func UserTrackWith(policy CookiePolicy) gin.HandlerFunc {
     return func(c *gin.Context) {
-        if _, err := c.Cookie(USER_TRACK_KEY); err != nil {
+        if _, err := policy.Get(c, USER_TRACK_KEY); err != nil {
             uuid := uuid.New().String()
-            c.SetCookie(USER_TRACK_KEY, uuid, longAfter, "", "", false, false)    
+            policy.Set(c, USER_TRACK_KEY, uuid, longAfter)
         }
         c.Next()
     }
 }
-
-
-
-
-